@@ -0,0 +1,12 @@
+-- One-off migration for databases created before auth_tokens existed.
+--
+-- password_reset_tokens and email_verification_tokens held tokens in
+-- plaintext. The API no longer reads them; run this once after deploying the
+-- auth_tokens change. Outstanding reset and verification links stop working,
+-- and users request new ones.
+BEGIN;
+
+DROP TABLE IF EXISTS password_reset_tokens;
+DROP TABLE IF EXISTS email_verification_tokens;
+
+COMMIT;
@@ -0,0 +1,19 @@
+-- One-off migration for databases created before emails were normalised.
+--
+-- Signup used to store the address as typed, so "Foo@x.com" and "foo@x.com"
+-- could become two accounts. This lowercases stored emails and makes them
+-- unique regardless of case. It fails, changing nothing, while any two
+-- accounts still differ only in case; find them with
+--
+--   SELECT lower(email), array_agg(id) FROM users
+--   WHERE email IS NOT NULL GROUP BY lower(email) HAVING COUNT(*) > 1;
+--
+-- and merge or rename them before running it again.
+BEGIN;
+
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+UPDATE user_identities SET email = lower(email) WHERE email <> lower(email);
+
+CREATE UNIQUE INDEX idx_users_email_lower ON users(lower(email));
+
+COMMIT;
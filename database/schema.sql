@@ -5,7 +5,8 @@ CREATE EXTENSION IF NOT EXISTS "pgcrypto";
 -- Users table
 CREATE TABLE users (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-    email VARCHAR(255) UNIQUE NOT NULL,
+    email VARCHAR(255) UNIQUE, -- NULL for accounts created by phone login
+    phone VARCHAR(20) UNIQUE, -- E.164, only stored once verified
     username VARCHAR(50) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
     first_name VARCHAR(100) NOT NULL,
@@ -15,6 +16,7 @@ CREATE TABLE users (
     is_verified BOOLEAN DEFAULT FALSE,
     is_active BOOLEAN DEFAULT TRUE,
     email_verified_at TIMESTAMP,
+    phone_verified_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
@@ -174,14 +176,26 @@ CREATE TABLE recipe_purchases (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     recipe_id UUID NOT NULL REFERENCES recipes(id) ON DELETE CASCADE,
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    amount DECIMAL(10,2) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL, -- the recipe's price when it was bought
     payment_method VARCHAR(50),
     payment_reference VARCHAR(255),
     status VARCHAR(20) DEFAULT 'pending' CHECK (status IN ('pending', 'completed', 'failed', 'refunded')),
+    checkout_url TEXT,
+    idempotency_key VARCHAR(255),
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Verified payment webhook deliveries, by SHA-256 digest of the raw body, so
+-- a replayed delivery is rejected
+CREATE TABLE payment_webhook_deliveries (
+    provider VARCHAR(32) NOT NULL,
+    body_hash VARCHAR(64) NOT NULL,
+    reference VARCHAR(255),
+    received_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (provider, body_hash)
+);
+
 -- User achievements table
 CREATE TABLE user_achievements (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -233,6 +247,136 @@ CREATE TABLE recipe_views (
     viewed_at TIMESTAMP DEFAULT NOW()
 );
 
+-- User roles table (every user implicitly has the "user" role)
+CREATE TABLE user_roles (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (user_id, role)
+);
+
+-- Audit trail of every role grant and revocation. Entries outlive the
+-- accounts they mention
+CREATE TABLE role_audit_log (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    role VARCHAR(50) NOT NULL,
+    action VARCHAR(10) NOT NULL CHECK (action IN ('grant', 'revoke')),
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    actor VARCHAR(255) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- User sessions table (one row per login, i.e. per refresh token family)
+CREATE TABLE user_sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT,
+    ip_address INET,
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_seen_at TIMESTAMP DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
+
+-- Refresh tokens table (opaque tokens stored as SHA-256 digests; every
+-- login starts a family and every refresh rotates within it)
+CREATE TABLE refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family_id UUID NOT NULL REFERENCES user_sessions(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Single-use tokens for password reset, email verification, etc. Only a
+-- SHA-256 digest of the secret part is stored, scoped by purpose. Redeemed
+-- and replaced tokens are kept, as they count towards the resend limits
+CREATE TABLE auth_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(32) NOT NULL,
+    selector VARCHAR(32) UNIQUE NOT NULL,
+    token_hash VARCHAR(64) NOT NULL,
+    payload TEXT,
+    expires_at TIMESTAMP NOT NULL,
+    consumed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- External login identities (Google, Facebook, ...). A provider account
+-- belongs to one user and a user has at most one account per provider
+CREATE TABLE user_identities (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(20) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_used_at TIMESTAMP,
+    UNIQUE(provider, subject),
+    UNIQUE(user_id, provider)
+);
+
+-- TOTP two-factor enrollments. last_used_step stops a code being replayed
+CREATE TABLE user_totp (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    enabled_at TIMESTAMP,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- One-time 2FA recovery codes, stored as SHA-256 digests
+CREATE TABLE user_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Failed attempt counters for login throttling (when LOGIN_ATTEMPT_STORE
+-- is postgres)
+CREATE TABLE login_attempts (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Temporary account lockouts after repeated failed logins, kept as a record
+-- for support
+CREATE TABLE account_lockouts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    email VARCHAR(255) NOT NULL, -- the phone number for accounts without an email
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    ip_address INET,
+    failures INTEGER NOT NULL,
+    locked_until TIMESTAMP NOT NULL,
+    unlocked_at TIMESTAMP,
+    unlocked_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Pending SMS login codes, one per phone number, stored as SHA-256 digests
+CREATE TABLE phone_otps (
+    phone VARCHAR(20) PRIMARY KEY,
+    code_hash VARCHAR(64) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Revoked access tokens (rows are only needed until the token expires)
+CREATE TABLE revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP DEFAULT NOW()
+);
+
 -- Create indexes for better performance
 CREATE INDEX idx_recipes_author_id ON recipes(author_id);
 CREATE INDEX idx_recipes_category_id ON recipes(category_id);
@@ -250,6 +394,18 @@ CREATE INDEX idx_user_follows_follower_id ON user_follows(follower_id);
 CREATE INDEX idx_user_follows_following_id ON user_follows(following_id);
 CREATE INDEX idx_recipe_views_recipe_id ON recipe_views(recipe_id);
 CREATE INDEX idx_recipe_views_viewed_at ON recipe_views(viewed_at DESC);
+CREATE INDEX idx_user_sessions_user_id ON user_sessions(user_id);
+CREATE INDEX idx_auth_tokens_user_id ON auth_tokens(user_id, purpose);
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX idx_user_recovery_codes_user_id ON user_recovery_codes(user_id);
+CREATE INDEX idx_account_lockouts_email ON account_lockouts(email, locked_until);
+CREATE INDEX idx_role_audit_log_user_id ON role_audit_log(user_id, created_at);
+-- Emails are stored lowercased and compared case-insensitively
+CREATE UNIQUE INDEX idx_users_email_lower ON users(lower(email));
+-- A user owns a recipe at most once, and an Idempotency-Key starts at most
+-- one purchase
+CREATE UNIQUE INDEX idx_recipe_purchases_completed ON recipe_purchases(user_id, recipe_id) WHERE status = 'completed';
+CREATE UNIQUE INDEX idx_recipe_purchases_idempotency_key ON recipe_purchases(user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
 
 -- Full text search indexes
 CREATE INDEX idx_recipes_search ON recipes USING gin(to_tsvector('english', title || ' ' || description));
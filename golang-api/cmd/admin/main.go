@@ -0,0 +1,210 @@
+// Command admin holds support tasks that run against the database directly.
+//
+//	go run ./cmd/admin lockouts [email|phone]
+//	go run ./cmd/admin unlock <email|phone>
+//	go run ./cmd/admin roles <email>
+//	go run ./cmd/admin grant <email> <role> [reason]
+//	go run ./cmd/admin revoke <email> <role> [reason]
+//	go run ./cmd/admin role-audit [email]
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/joho/godotenv"
+	"recipehub/models"
+	"recipehub/services"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: admin <command> [arguments]
+
+Commands:
+  lockouts [email|phone]          list recent account lockouts
+  unlock <email|phone>            lift an active lockout
+  roles <email>                   show a user's roles
+  grant <email> <role> [reason]   grant a role (`+strings.Join(services.AssignableRoles, ", ")+`)
+  revoke <email> <role> [reason]  revoke a role
+  role-audit [email]              list recent role changes`)
+	os.Exit(2)
+}
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	dbService := services.NewDatabaseService()
+
+	switch os.Args[1] {
+	case "lockouts":
+		email := ""
+		if len(os.Args) > 2 {
+			email = os.Args[2]
+		}
+		listLockouts(dbService, email)
+	case "unlock":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		unlock(dbService, os.Args[2])
+	case "roles":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		listRoles(dbService, os.Args[2])
+	case "grant", "revoke":
+		if len(os.Args) < 4 {
+			usage()
+		}
+		changeRole(dbService, os.Args[1] == "grant", os.Args[2], os.Args[3], strings.Join(os.Args[4:], " "))
+	case "role-audit":
+		email := ""
+		if len(os.Args) > 2 {
+			email = os.Args[2]
+		}
+		roleAudit(dbService, email)
+	default:
+		usage()
+	}
+}
+
+func listLockouts(dbService *services.DatabaseService, email string) {
+	if email != "" {
+		account, err := services.ParseLoginAccount(email)
+		if err != nil {
+			log.Fatalf("Invalid email or phone number %q", email)
+		}
+		email = account
+	}
+
+	lockouts, err := dbService.GetAccountLockouts(email, 50)
+	if err != nil {
+		log.Fatalf("Failed to load lockouts: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tIP\tFAILURES\tLOCKED AT\tLOCKED UNTIL\tSTATUS")
+	for _, l := range lockouts {
+		status := "expired"
+		if l.Active {
+			status = "active"
+		} else if l.UnlockedAt != nil {
+			status = "unlocked by " + l.UnlockedBy
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			l.Email, l.IPAddress, l.Failures,
+			l.CreatedAt.Format("2006-01-02 15:04"), l.LockedUntil.Format("2006-01-02 15:04"), status)
+	}
+	w.Flush()
+}
+
+func unlock(dbService *services.DatabaseService, email string) {
+	throttle := services.NewLoginThrottle(services.NewAttemptStore(dbService), dbService)
+
+	account, err := services.ParseLoginAccount(email)
+	if err != nil {
+		log.Fatalf("Invalid email or phone number %q", email)
+	}
+
+	unlocked, err := throttle.UnlockAccount(account, operator())
+	if err != nil {
+		log.Fatalf("Failed to unlock %s: %v", email, err)
+	}
+
+	if !unlocked {
+		fmt.Printf("No active lockout for %s\n", email)
+		return
+	}
+	fmt.Printf("%s unlocked\n", email)
+}
+
+// operator names whoever runs the CLI in audit records.
+func operator() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "cli:" + user
+	}
+	return "cli"
+}
+
+func findUser(dbService *services.DatabaseService, email string) *models.User {
+	user, err := dbService.GetUserByEmail(email)
+	if err != nil {
+		log.Fatalf("No user with email %s", email)
+	}
+	return user
+}
+
+func listRoles(dbService *services.DatabaseService, email string) {
+	user := findUser(dbService, email)
+
+	roles, err := dbService.GetUserRoleAssignments(user.ID)
+	if err != nil {
+		log.Fatalf("Failed to load roles: %v", err)
+	}
+
+	fmt.Printf("%s (implicit)\n", services.DefaultRole)
+	for _, role := range roles {
+		fmt.Printf("%s (granted %s)\n", role.Role, role.CreatedAt.Format("2006-01-02 15:04"))
+	}
+}
+
+func changeRole(dbService *services.DatabaseService, grant bool, email, role, reason string) {
+	if !services.IsAssignableRole(role) {
+		log.Fatalf("Unknown role %q; assignable roles are %s", role, strings.Join(services.AssignableRoles, ", "))
+	}
+
+	user := findUser(dbService, email)
+	actor := &models.RoleActor{Name: operator()}
+
+	if grant {
+		changed, err := dbService.GrantRole(user.ID, role, actor, reason)
+		if err != nil {
+			log.Fatalf("Failed to grant %s: %v", role, err)
+		}
+		if !changed {
+			fmt.Printf("%s already has %s\n", email, role)
+			return
+		}
+		fmt.Printf("Granted %s to %s\n", role, email)
+		return
+	}
+
+	changed, err := dbService.RevokeRole(user.ID, role, actor, reason)
+	if err != nil {
+		log.Fatalf("Failed to revoke %s: %v", role, err)
+	}
+	if !changed {
+		fmt.Printf("%s doesn't have %s\n", email, role)
+		return
+	}
+	fmt.Printf("Revoked %s from %s\n", role, email)
+}
+
+func roleAudit(dbService *services.DatabaseService, email string) {
+	userID := ""
+	if email != "" {
+		userID = findUser(dbService, email).ID
+	}
+
+	entries, err := dbService.GetRoleAuditLog(userID, 50)
+	if err != nil {
+		log.Fatalf("Failed to load role audit log: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WHEN\tUSER\tACTION\tROLE\tBY\tREASON")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.CreatedAt.Format("2006-01-02 15:04"), e.UserID, e.Action, e.Role, e.Actor, e.Reason)
+	}
+	w.Flush()
+}
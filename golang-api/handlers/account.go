@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/models"
+	"recipehub/services"
+)
+
+// ChangePassword replaces the signed-in user's password after checking the
+// current one, and signs out every other session.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	var req struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid request data: " + err.Error(),
+		})
+		return
+	}
+
+	user, err := h.dbService.GetUserByID(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, AuthResponse{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	if user.Password == "" {
+		c.JSON(http.StatusConflict, AuthResponse{
+			Success: false,
+			Message: "This account has no password yet. Use /auth/set-password instead.",
+		})
+		return
+	}
+
+	if !h.checkCurrentPassword(c, user, req.CurrentPassword) {
+		return
+	}
+
+	if violations := h.authService.ValidatePassword(req.NewPassword, user.Email, user.Username); len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Password does not meet the requirements",
+			Errors:  violations,
+		})
+		return
+	}
+
+	hashedPassword, err := h.authService.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process new password",
+		})
+		return
+	}
+
+	if err := h.dbService.UpdateUserPassword(user.ID, hashedPassword); err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to update password",
+		})
+		return
+	}
+
+	// Whoever knew the old password may still be signed in elsewhere or
+	// holding a reset link
+	if _, err := h.dbService.RevokeOtherSessions(user.ID, c.GetString("session_id")); err != nil {
+		log.Printf("Failed to revoke other sessions of user %s: %v", user.ID, err)
+	}
+	if err := h.dbService.ExpireUserAuthTokens(user.ID, services.TokenPurposePasswordReset); err != nil {
+		log.Printf("Failed to expire reset tokens of user %s: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Success: true,
+		Message: "Password changed. Your other sessions have been signed out.",
+	})
+}
+
+// ChangeEmail starts an email change: the new address gets a confirmation
+// link and the current one a notice. Nothing changes until the link is
+// redeemed at /auth/confirm-email-change. The user has to prove it is still
+// them first; see reauthenticate.
+func (h *AuthHandler) ChangeEmail(c *gin.Context) {
+	var req struct {
+		NewEmail string `json:"new_email" binding:"required,email"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid request data: " + err.Error(),
+		})
+		return
+	}
+	newEmail := services.NormalizeEmail(req.NewEmail)
+
+	user, err := h.dbService.GetUserByID(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, AuthResponse{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	if !h.reauthenticate(c, user, req.Password, req.Code) {
+		return
+	}
+
+	if strings.EqualFold(newEmail, user.Email) {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "That is already your email address",
+		})
+		return
+	}
+
+	if _, err := h.dbService.GetUserByEmail(newEmail); err == nil {
+		c.JSON(http.StatusConflict, AuthResponse{
+			Success: false,
+			Message: "That email address is already in use",
+		})
+		return
+	}
+
+	retryAfter, err := h.emailRetryAfter(user.ID, services.TokenPurposeEmailChange)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process email change",
+		})
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(c, retryAfter)
+		c.JSON(http.StatusTooManyRequests, AuthResponse{
+			Success: false,
+			Message: "Please wait before requesting another email change",
+		})
+		return
+	}
+
+	token, err := h.authService.IssueTokenWithPayload(user.ID, services.TokenPurposeEmailChange, newEmail, services.EmailChangeTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process email change",
+		})
+		return
+	}
+
+	if err := h.emailService.SendEmailChangeConfirmation(user, newEmail, token, services.EmailChangeTokenTTL); err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to send confirmation email",
+		})
+		return
+	}
+
+	// Accounts created by phone login may not have an address to notify
+	if user.Email != "" {
+		if err := h.emailService.SendEmailChangeNotice(user, newEmail); err != nil {
+			log.Printf("Failed to notify %s of email change for user %s: %v", user.Email, user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Success: true,
+		Message: "We sent a confirmation link to " + newEmail + ". Your email will change once you open it.",
+	})
+}
+
+// ConfirmEmailChange redeems an email change link and switches the account
+// to the new, now verified, address.
+func (h *AuthHandler) ConfirmEmailChange(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Confirmation token required",
+		})
+		return
+	}
+
+	userID, newEmail, err := h.authService.ConsumeTokenWithPayload(services.TokenPurposeEmailChange, req.Token)
+	if errors.Is(err, services.ErrInvalidToken) || (err == nil && newEmail == "") {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid or expired confirmation link",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to confirm email change",
+		})
+		return
+	}
+
+	updated, err := h.dbService.UpdateUserEmail(userID, newEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to confirm email change",
+		})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusConflict, AuthResponse{
+			Success: false,
+			Message: "That email address is already in use",
+		})
+		return
+	}
+
+	// Links sent to the old address must stop working, above all the ones
+	// that sign in or reset the password
+	for _, purpose := range []services.TokenPurpose{
+		services.TokenPurposeEmailVerification,
+		services.TokenPurposeMagicLink,
+		services.TokenPurposePasswordReset,
+	} {
+		if err := h.dbService.ExpireUserAuthTokens(userID, purpose); err != nil {
+			log.Printf("Failed to expire %s tokens of user %s: %v", purpose, userID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Success: true,
+		Message: "Email address updated",
+	})
+}
+
+// checkCurrentPassword re-authenticates a signed-in user before a sensitive
+// change. Wrong guesses count towards the login throttle like failed logins
+// do. It writes the error response and returns false if the check fails.
+func (h *AuthHandler) checkCurrentPassword(c *gin.Context, user *models.User, password string) bool {
+	retryAfter, _, err := h.throttle.CheckLogin(c.ClientIP(), services.LoginAccount(user))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to check password",
+		})
+		return false
+	}
+	if retryAfter > 0 {
+		setRetryAfter(c, retryAfter)
+		c.JSON(http.StatusTooManyRequests, AuthResponse{
+			Success: false,
+			Message: "Too many failed attempts. Please try again later.",
+		})
+		return false
+	}
+
+	if password == "" || !h.authService.CheckPassword(password, user.Password) {
+		if _, err := h.throttle.LoginFailed(c.ClientIP(), services.LoginAccount(user), user.ID); err != nil {
+			log.Printf("Failed to record failed password check: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Current password is incorrect",
+		})
+		return false
+	}
+
+	return true
+}
+
+// recentLoginWindow is how long after signing in a passwordless account may
+// make sensitive changes without signing in again.
+const recentLoginWindow = 10 * time.Minute
+
+// reauthenticate makes sure a sensitive change comes from the account owner
+// and not just from someone holding their access token. Accounts with a
+// password give it; passwordless accounts give a TOTP or recovery code when
+// 2FA is on, and otherwise must have signed in within recentLoginWindow. It
+// writes the error response and returns false if the check fails.
+func (h *AuthHandler) reauthenticate(c *gin.Context, user *models.User, password, code string) bool {
+	if user.Password != "" {
+		return h.checkCurrentPassword(c, user, password)
+	}
+
+	mfaEnabled, err := h.dbService.IsTOTPEnabled(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to verify your identity",
+		})
+		return false
+	}
+
+	if mfaEnabled {
+		valid, err := h.authService.VerifySecondFactor(user.ID, code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, AuthResponse{
+				Success: false,
+				Message: "Failed to verify your identity",
+			})
+			return false
+		}
+		if !valid {
+			if _, err := h.throttle.LoginFailed(c.ClientIP(), services.LoginAccount(user), user.ID); err != nil {
+				log.Printf("Failed to record failed code check: %v", err)
+			}
+			c.JSON(http.StatusUnauthorized, AuthResponse{
+				Success: false,
+				Message: "Invalid verification code",
+			})
+			return false
+		}
+		return true
+	}
+
+	age, err := h.dbService.SessionAge(user.ID, c.GetString("session_id"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to verify your identity",
+		})
+		return false
+	}
+	if err != nil || age > recentLoginWindow {
+		c.JSON(http.StatusForbidden, AuthResponse{
+			Success: false,
+			Message: "Please sign in again to make this change",
+		})
+		return false
+	}
+
+	return true
+}
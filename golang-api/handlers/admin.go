@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/models"
+	"recipehub/services"
+)
+
+// AdminHandler serves the /admin endpoints. Role management needs the admin
+// role; account support (lockouts) is also open to moderators.
+type AdminHandler struct {
+	dbService *services.DatabaseService
+	throttle  *services.LoginThrottle
+}
+
+func NewAdminHandler(dbService *services.DatabaseService, throttle *services.LoginThrottle) *AdminHandler {
+	return &AdminHandler{
+		dbService: dbService,
+		throttle:  throttle,
+	}
+}
+
+type RoleChangeRequest struct {
+	Role   string `json:"role" binding:"required"`
+	Reason string `json:"reason"`
+}
+
+func (h *AdminHandler) ListUserRoles(c *gin.Context) {
+	userID := c.Param("id")
+
+	if _, err := h.dbService.GetUserByID(userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "User not found",
+		})
+		return
+	}
+
+	roles, err := h.dbService.GetUserRoleAssignments(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to load roles",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"default_role": services.DefaultRole,
+		"roles":        roles,
+	})
+}
+
+// GrantRole adds a role to the user. It shows up in their access tokens from
+// their next login or token refresh.
+func (h *AdminHandler) GrantRole(c *gin.Context) {
+	var req RoleChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Invalid request data: " + err.Error(),
+		})
+		return
+	}
+
+	h.changeRole(c, c.Param("id"), req.Role, req.Reason, true)
+}
+
+// RevokeRole removes a role from the user. Access tokens already issued keep
+// it until they expire.
+func (h *AdminHandler) RevokeRole(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&req)
+
+	userID, role := c.Param("id"), c.Param("role")
+
+	// An admin removing their own admin role could leave nobody able to
+	// manage roles
+	if userID == c.GetString("user_id") && role == services.RoleAdmin {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"message": "You can't revoke your own admin role",
+		})
+		return
+	}
+
+	h.changeRole(c, userID, role, req.Reason, false)
+}
+
+func (h *AdminHandler) changeRole(c *gin.Context, userID, role, reason string, grant bool) {
+	if !services.IsAssignableRole(role) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Unknown role: " + role,
+		})
+		return
+	}
+
+	if _, err := h.dbService.GetUserByID(userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "User not found",
+		})
+		return
+	}
+
+	actor := &models.RoleActor{
+		UserID: c.GetString("user_id"),
+		Name:   c.GetString("username"),
+	}
+
+	var changed bool
+	var err error
+	if grant {
+		changed, err = h.dbService.GrantRole(userID, role, actor, reason)
+	} else {
+		changed, err = h.dbService.RevokeRole(userID, role, actor, reason)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to update roles",
+		})
+		return
+	}
+
+	message := "Role granted"
+	switch {
+	case grant && !changed:
+		message = "User already has this role"
+	case !grant && changed:
+		message = "Role revoked"
+	case !grant && !changed:
+		message = "User doesn't have this role"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": message,
+		"changed": changed,
+	})
+}
+
+func (h *AdminHandler) RoleAuditLog(c *gin.Context) {
+	entries, err := h.dbService.GetRoleAuditLog(c.Query("user_id"), 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to load audit log",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"entries": entries,
+	})
+}
+
+func (h *AdminHandler) ListLockouts(c *gin.Context) {
+	// Phone login accounts have no email and are locked by phone number
+	account := services.NormalizeEmail(c.Query("email"))
+	if phone := c.Query("phone"); account == "" && phone != "" {
+		normalized, err := services.NormalizePhone(phone)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"message": "Invalid phone number",
+			})
+			return
+		}
+		account = normalized
+	}
+
+	lockouts, err := h.dbService.GetAccountLockouts(account, 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to load lockouts",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"lockouts": lockouts,
+	})
+}
+
+func (h *AdminHandler) UnlockAccount(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"omitempty,email"`
+		Phone string `json:"phone"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Email == "") == (req.Phone == "") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Email address or phone number required",
+		})
+		return
+	}
+
+	// Phone login accounts have no email and are locked by phone number
+	account := req.Email
+	if req.Phone != "" {
+		normalized, err := services.NormalizePhone(req.Phone)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"message": "Invalid phone number",
+			})
+			return
+		}
+		account = normalized
+	}
+
+	unlocked, err := h.throttle.UnlockAccount(account, c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to unlock account",
+		})
+		return
+	}
+
+	if !unlocked {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "No active lockout for this account",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Account unlocked",
+	})
+}
@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"recipehub/models"
@@ -10,16 +15,26 @@ import (
 )
 
 type AuthHandler struct {
-	authService   *services.AuthService
-	dbService     *services.DatabaseService
-	hasuraService *services.HasuraService
+	authService     *services.AuthService
+	dbService       *services.DatabaseService
+	hasuraService   *services.HasuraService
+	emailService    *services.EmailService
+	googleService   *services.GoogleService
+	facebookService *services.FacebookService
+	throttle        *services.LoginThrottle
+	smsSender       services.SMSSender
 }
 
-func NewAuthHandler(authService *services.AuthService, dbService *services.DatabaseService, hasuraService *services.HasuraService) *AuthHandler {
+func NewAuthHandler(authService *services.AuthService, dbService *services.DatabaseService, hasuraService *services.HasuraService, emailService *services.EmailService, googleService *services.GoogleService, facebookService *services.FacebookService, throttle *services.LoginThrottle, smsSender services.SMSSender) *AuthHandler {
 	return &AuthHandler{
-		authService:   authService,
-		dbService:     dbService,
-		hasuraService: hasuraService,
+		authService:     authService,
+		dbService:       dbService,
+		hasuraService:   hasuraService,
+		emailService:    emailService,
+		googleService:   googleService,
+		facebookService: facebookService,
+		throttle:        throttle,
+		smsSender:       smsSender,
 	}
 }
 
@@ -28,7 +43,7 @@ type SignupRequest struct {
 	Username  string `json:"username" binding:"required,min=3,max=50"`
 	FirstName string `json:"first_name" binding:"required"`
 	LastName  string `json:"last_name" binding:"required"`
-	Password  string `json:"password" binding:"required,min=8"`
+	Password  string `json:"password" binding:"required"`
 	Bio       string `json:"bio"`
 	Avatar    string `json:"avatar"`
 }
@@ -44,6 +59,13 @@ type AuthResponse struct {
 	AccessToken  string `json:"access_token,omitempty"`
 	RefreshToken string `json:"refresh_token,omitempty"`
 	User         *models.User `json:"user,omitempty"`
+
+	// Set instead of the tokens when the user still has to pass 2FA
+	MFARequired    bool   `json:"mfa_required,omitempty"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
+
+	// Field-level validation problems, e.g. with a new password
+	Errors []services.FieldError `json:"errors,omitempty"`
 }
 
 func (h *AuthHandler) Signup(c *gin.Context) {
@@ -56,6 +78,8 @@ func (h *AuthHandler) Signup(c *gin.Context) {
 		return
 	}
 
+	req.Email = services.NormalizeEmail(req.Email)
+
 	// Check if user already exists
 	existingUser, _ := h.dbService.GetUserByEmail(req.Email)
 	if existingUser != nil {
@@ -76,6 +100,16 @@ func (h *AuthHandler) Signup(c *gin.Context) {
 		return
 	}
 
+	// Check the password against the policy
+	if violations := h.authService.ValidatePassword(req.Password, req.Email, req.Username); len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Password does not meet the requirements",
+			Errors:  violations,
+		})
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := h.authService.HashPassword(req.Password)
 	if err != nil {
@@ -105,11 +139,10 @@ func (h *AuthHandler) Signup(c *gin.Context) {
 		return
 	}
 
-	// Generate email verification token
-	verificationToken, err := h.authService.GenerateEmailVerificationToken()
-	if err != nil {
-		// Log error but don't fail signup
-		// In production, you'd want to send verification email
+	// Send the verification email; a failure shouldn't fail signup since the
+	// user can ask for a new link
+	if err := h.sendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
 	}
 
 	c.JSON(http.StatusCreated, AuthResponse{
@@ -129,18 +162,41 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Get user by email
-	user, err := h.dbService.GetUserByEmail(req.Email)
+	// Slow down password guessing before touching the account at all
+	retryAfter, locked, err := h.throttle.CheckLogin(c.ClientIP(), req.Email)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, AuthResponse{
+		c.JSON(http.StatusInternalServerError, AuthResponse{
 			Success: false,
-			Message: "Invalid email or password",
+			Message: "Failed to process login",
+		})
+		return
+	}
+	if retryAfter > 0 {
+		message := "Too many login attempts. Please try again later."
+		if locked {
+			message = "Too many failed login attempts. This account is temporarily locked."
+		}
+		setRetryAfter(c, retryAfter)
+		c.JSON(http.StatusTooManyRequests, AuthResponse{
+			Success: false,
+			Message: message,
 		})
 		return
 	}
 
-	// Check password
-	if !h.authService.CheckPassword(req.Password, user.Password) {
+	// Get user by email and check password
+	user, err := h.dbService.GetUserByEmail(req.Email)
+	if err != nil || !h.authService.CheckPassword(req.Password, user.Password) {
+		userID := ""
+		if user != nil {
+			userID = user.ID
+		} else {
+			h.authService.CheckMissingPassword(req.Password)
+		}
+		if _, err := h.throttle.LoginFailed(c.ClientIP(), req.Email, userID); err != nil {
+			log.Printf("Failed to record failed login: %v", err)
+		}
+
 		c.JSON(http.StatusUnauthorized, AuthResponse{
 			Success: false,
 			Message: "Invalid email or password",
@@ -157,8 +213,63 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	// Upgrade bcrypt or outdated argon2id hashes while we have the password
+	if h.authService.NeedsRehash(user.Password) {
+		if hashedPassword, err := h.authService.HashPassword(req.Password); err != nil {
+			log.Printf("Failed to rehash password for user %s: %v", user.ID, err)
+		} else if err := h.dbService.UpdateUserPassword(user.ID, hashedPassword); err != nil {
+			log.Printf("Failed to store rehashed password for user %s: %v", user.ID, err)
+		}
+	}
+
+	h.completeLogin(c, user)
+}
+
+// completeLogin is where every login method ends once the user has proven
+// who they are. Users with 2FA get a short-lived challenge token to redeem
+// at /auth/2fa/verify; everyone else gets their tokens straight away.
+func (h *AuthHandler) completeLogin(c *gin.Context, user *models.User) {
+	enabled, err := h.dbService.IsTOTPEnabled(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process login",
+		})
+		return
+	}
+
+	if enabled {
+		challenge, err := h.authService.IssueToken(user.ID, services.TokenPurposeMFAChallenge, services.MFAChallengeTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, AuthResponse{
+				Success: false,
+				Message: "Failed to process login",
+			})
+			return
+		}
+
+		// Not signed in yet: success stays false until /auth/2fa/verify
+		c.JSON(http.StatusOK, AuthResponse{
+			Success:        false,
+			Message:        "Two-factor authentication required",
+			MFARequired:    true,
+			ChallengeToken: challenge,
+		})
+		return
+	}
+
+	h.respondWithTokens(c, user)
+}
+
+// respondWithTokens starts a new session for the user and responds with its
+// tokens.
+func (h *AuthHandler) respondWithTokens(c *gin.Context, user *models.User) {
+	if err := h.throttle.LoginSucceeded(services.LoginAccount(user)); err != nil {
+		log.Printf("Failed to reset login attempts for user %s: %v", user.ID, err)
+	}
+
 	// Generate tokens
-	accessToken, refreshToken, err := h.authService.GenerateTokens(user)
+	accessToken, refreshToken, err := h.issueTokens(c, user, "")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, AuthResponse{
 			Success: false,
@@ -180,27 +291,45 @@ func (h *AuthHandler) Login(c *gin.Context) {
 }
 
 func (h *AuthHandler) RefreshToken(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, AuthResponse{
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
 			Success: false,
-			Message: "Authorization header required",
+			Message: "Refresh token required",
 		})
 		return
 	}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	claims, err := h.authService.ValidateToken(tokenString)
-	if err != nil {
+	// Redeem the refresh token; each one can only be used once
+	tokenHash := h.authService.HashRefreshToken(req.RefreshToken)
+	current, err := h.dbService.RotateRefreshToken(tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// A token that was already rotated is being replayed, so assume it
+		// leaked and end every session descended from the same login
+		stored, lookupErr := h.dbService.GetRefreshTokenByHash(tokenHash)
+		if lookupErr == nil && stored.RotatedAt != nil {
+			h.dbService.RevokeSession(stored.FamilyID)
+		}
+
 		c.JSON(http.StatusUnauthorized, AuthResponse{
 			Success: false,
 			Message: "Invalid refresh token",
 		})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to refresh token",
+		})
+		return
+	}
 
 	// Get user
-	user, err := h.dbService.GetUserByID(claims.UserID)
+	user, err := h.dbService.GetUserByID(current.UserID)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, AuthResponse{
 			Success: false,
@@ -209,8 +338,17 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 		return
 	}
 
-	// Generate new tokens
-	accessToken, refreshToken, err := h.authService.GenerateTokens(user)
+	if !user.IsActive {
+		h.dbService.RevokeSession(current.FamilyID)
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Account is deactivated",
+		})
+		return
+	}
+
+	// Generate new tokens in the same session
+	accessToken, refreshToken, err := h.issueTokens(c, user, current.FamilyID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, AuthResponse{
 			Success: false,
@@ -227,6 +365,51 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	})
 }
 
+// issueTokens signs an access token and stores a new refresh token for
+// sessionID. An empty sessionID starts a new session for this device; an
+// existing one has its IP address, user agent and last-seen time updated.
+func (h *AuthHandler) issueTokens(c *gin.Context, user *models.User, sessionID string) (string, string, error) {
+	if sessionID == "" {
+		session := &models.Session{
+			UserID:    user.ID,
+			UserAgent: c.GetHeader("User-Agent"),
+			IPAddress: c.ClientIP(),
+		}
+		if err := h.dbService.CreateSession(session); err != nil {
+			return "", "", err
+		}
+		sessionID = session.ID
+	} else if err := h.dbService.TouchSession(sessionID, c.ClientIP(), c.GetHeader("User-Agent")); err != nil {
+		return "", "", err
+	}
+
+	roles, err := h.dbService.GetUserRoles(user.ID)
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := h.authService.GenerateAccessToken(user, roles, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, tokenHash, err := h.authService.GenerateRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	err = h.dbService.CreateRefreshToken(&models.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  sessionID,
+		TokenHash: tokenHash,
+	}, services.RefreshTokenTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
 func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 	var req struct {
 		Email string `json:"email" binding:"required,email"`
@@ -240,6 +423,24 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 		return
 	}
 
+	// Limit reset emails per IP and per address, whether or not it exists
+	retryAfter, err := h.throttle.AllowPasswordReset(c.ClientIP(), req.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process password reset request",
+		})
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(c, retryAfter)
+		c.JSON(http.StatusTooManyRequests, AuthResponse{
+			Success: false,
+			Message: "Too many password reset requests. Please try again later.",
+		})
+		return
+	}
+
 	// Check if user exists
 	user, err := h.dbService.GetUserByEmail(req.Email)
 	if err != nil {
@@ -251,18 +452,9 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 		return
 	}
 
-	// Generate reset token
-	resetToken, err := h.authService.GenerateResetToken()
+	// Issue a reset token; only its digest is stored
+	resetToken, err := h.authService.IssueToken(user.ID, services.TokenPurposePasswordReset, services.PasswordResetTokenTTL)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, AuthResponse{
-			Success: false,
-			Message: "Failed to generate reset token",
-		})
-		return
-	}
-
-	// Save reset token to database (implement this in dbService)
-	if err := h.dbService.SavePasswordResetToken(user.ID, resetToken); err != nil {
 		c.JSON(http.StatusInternalServerError, AuthResponse{
 			Success: false,
 			Message: "Failed to process password reset request",
@@ -270,8 +462,11 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 		return
 	}
 
-	// In production, send email with reset link
-	// emailService.SendPasswordResetEmail(user.Email, resetToken)
+	// Send the reset link. A delivery failure is only logged so the response
+	// never reveals whether the account exists
+	if err := h.emailService.SendPasswordResetEmail(user, resetToken, services.PasswordResetTokenTTL); err != nil {
+		log.Printf("Failed to send password reset email to user %s: %v", user.ID, err)
+	}
 
 	c.JSON(http.StatusOK, AuthResponse{
 		Success: true,
@@ -282,7 +477,7 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 func (h *AuthHandler) ResetPassword(c *gin.Context) {
 	var req struct {
 		Token    string `json:"token" binding:"required"`
-		Password string `json:"password" binding:"required,min=8"`
+		Password string `json:"password" binding:"required"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -293,8 +488,25 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 		return
 	}
 
-	// Verify reset token
-	userID, err := h.dbService.VerifyPasswordResetToken(req.Token)
+	// Check the token without using it up, so a rejected password can be
+	// retried with the same link
+	userID, err := h.authService.PeekToken(services.TokenPurposePasswordReset, req.Token)
+	if errors.Is(err, services.ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid or expired reset token",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process password reset",
+		})
+		return
+	}
+
+	user, err := h.dbService.GetUserByID(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, AuthResponse{
 			Success: false,
@@ -303,6 +515,24 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 		return
 	}
 
+	if violations := h.authService.ValidatePassword(req.Password, user.Email, user.Username); len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Password does not meet the requirements",
+			Errors:  violations,
+		})
+		return
+	}
+
+	// Redeem the reset token; it can't be used again afterwards
+	if _, err := h.authService.ConsumeToken(services.TokenPurposePasswordReset, req.Token); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid or expired reset token",
+		})
+		return
+	}
+
 	// Hash new password
 	hashedPassword, err := h.authService.HashPassword(req.Password)
 	if err != nil {
@@ -322,9 +552,6 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 		return
 	}
 
-	// Delete used reset token
-	h.dbService.DeletePasswordResetToken(req.Token)
-
 	c.JSON(http.StatusOK, AuthResponse{
 		Success: true,
 		Message: "Password reset successfully",
@@ -344,15 +571,22 @@ func (h *AuthHandler) VerifyEmail(c *gin.Context) {
 		return
 	}
 
-	// Verify email token
-	userID, err := h.dbService.VerifyEmailToken(req.Token)
-	if err != nil {
+	// Redeem the token; it can't be used again afterwards
+	userID, err := h.authService.ConsumeToken(services.TokenPurposeEmailVerification, req.Token)
+	if errors.Is(err, services.ErrInvalidToken) {
 		c.JSON(http.StatusBadRequest, AuthResponse{
 			Success: false,
 			Message: "Invalid or expired verification token",
 		})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to verify email",
+		})
+		return
+	}
 
 	// Mark email as verified
 	if err := h.dbService.MarkEmailAsVerified(userID); err != nil {
@@ -363,54 +597,154 @@ func (h *AuthHandler) VerifyEmail(c *gin.Context) {
 		return
 	}
 
+	// Any other outstanding verification links are no longer needed
+	h.dbService.ExpireUserAuthTokens(userID, services.TokenPurposeEmailVerification)
+
 	c.JSON(http.StatusOK, AuthResponse{
 		Success: true,
 		Message: "Email verified successfully",
 	})
 }
 
-func (h *AuthHandler) GoogleLogin(c *gin.Context) {
+func (h *AuthHandler) ResendVerification(c *gin.Context) {
 	var req struct {
-		GoogleToken string `json:"google_token" binding:"required"`
+		Email string `json:"email"`
 	}
+	c.ShouldBindJSON(&req)
 
-	if err := c.ShouldBindJSON(&req); err != nil {
+	const genericMessage = "If the account exists and is not yet verified, a new verification link has been sent."
+
+	// Signed-in users get precise answers; anonymous callers always get the
+	// same response so it can't be used to probe for accounts
+	userID := c.GetString("user_id")
+	authenticated := userID != ""
+
+	var user *models.User
+	var err error
+	if authenticated {
+		user, err = h.dbService.GetUserByID(userID)
+	} else if req.Email != "" {
+		user, err = h.dbService.GetUserByEmail(req.Email)
+	} else {
 		c.JSON(http.StatusBadRequest, AuthResponse{
 			Success: false,
-			Message: "Google token required",
+			Message: "Email address required",
+		})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusOK, AuthResponse{
+			Success: true,
+			Message: genericMessage,
 		})
 		return
 	}
 
-	// Verify Google token and get user info
-	// This would integrate with Google OAuth API
-	// For now, we'll return a placeholder response
+	// Accounts created by phone login have no address to verify yet
+	if authenticated && user.Email == "" {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Add an email address to your account first",
+		})
+		return
+	}
 
-	c.JSON(http.StatusNotImplemented, AuthResponse{
-		Success: false,
-		Message: "Google login not implemented yet",
-	})
-}
+	if user.IsVerified {
+		message := genericMessage
+		if authenticated {
+			message = "Email is already verified"
+		}
+		c.JSON(http.StatusOK, AuthResponse{
+			Success: true,
+			Message: message,
+		})
+		return
+	}
 
-func (h *AuthHandler) FacebookLogin(c *gin.Context) {
-	var req struct {
-		FacebookToken string `json:"facebook_token" binding:"required"`
+	retryAfter, err := h.emailRetryAfter(user.ID, services.TokenPurposeEmailVerification)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process verification request",
+		})
+		return
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, AuthResponse{
+	if retryAfter > 0 {
+		if !authenticated {
+			c.JSON(http.StatusOK, AuthResponse{
+				Success: true,
+				Message: genericMessage,
+			})
+			return
+		}
+
+		setRetryAfter(c, retryAfter)
+		c.JSON(http.StatusTooManyRequests, AuthResponse{
 			Success: false,
-			Message: "Facebook token required",
+			Message: "Please wait before requesting another verification email",
 		})
 		return
 	}
 
-	// Verify Facebook token and get user info
-	// This would integrate with Facebook Graph API
-	// For now, we'll return a placeholder response
+	if err := h.sendVerificationEmail(user); err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to send verification email",
+		})
+		return
+	}
 
-	c.JSON(http.StatusNotImplemented, AuthResponse{
-		Success: false,
-		Message: "Facebook login not implemented yet",
+	message := genericMessage
+	if authenticated {
+		message = "Verification email sent"
+	}
+	c.JSON(http.StatusOK, AuthResponse{
+		Success: true,
+		Message: message,
 	})
 }
+
+// sendVerificationEmail stores a fresh verification token for the user and
+// emails the link.
+func (h *AuthHandler) sendVerificationEmail(user *models.User) error {
+	token, err := h.authService.IssueToken(user.ID, services.TokenPurposeEmailVerification, services.EmailVerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return h.emailService.SendVerificationEmail(user, token, services.EmailVerificationTokenTTL)
+}
+
+// emailRetryAfter returns how long the user has to wait before another
+// email carrying a token of purpose may be sent, or zero if one may go out
+// now. Verification and email change links share the same limits.
+func (h *AuthHandler) emailRetryAfter(userID string, purpose services.TokenPurpose) (time.Duration, error) {
+	count, oldest, latest, err := h.dbService.GetAuthTokenActivity(userID, purpose)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	if count >= services.EmailVerificationDailyLimit {
+		return 24*time.Hour - oldest, nil
+	}
+
+	if latest < services.EmailVerificationCooldown {
+		return services.EmailVerificationCooldown - latest, nil
+	}
+
+	return 0, nil
+}
+
+// setRetryAfter tells the client how many whole seconds to wait.
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// JWKS serves the public half of the signing keyset so Hasura and other
+// verifiers can check tokens without holding any private material.
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.authService.JWKS())
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/services"
+)
+
+// FileHandler serves the /upload routes main.go already registered, as thin
+// wrappers around FileService: single and multiple image uploads (optionally
+// filed under a "category" form field) and deleting an image by file name.
+type FileHandler struct {
+	fileService *services.FileService
+}
+
+func NewFileHandler(fileService *services.FileService) *FileHandler {
+	return &FileHandler{
+		fileService: fileService,
+	}
+}
+
+func (h *FileHandler) UploadImage(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Image file required",
+		})
+		return
+	}
+
+	result, err := h.fileService.UploadImage(file, c.PostForm("category"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *FileHandler) UploadMultipleImages(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["files"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "At least one image file required",
+		})
+		return
+	}
+
+	results, err := h.fileService.UploadMultipleImages(form.File["files"], c.PostForm("category"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"files":   results,
+	})
+}
+
+func (h *FileHandler) DeleteImage(c *gin.Context) {
+	filename := c.Param("filename")
+
+	if err := h.fileService.DeleteImage(filename); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Image deleted",
+	})
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/models"
+)
+
+// ListIdentities returns the providers linked to the user and whether they
+// can also sign in with a password.
+func (h *AuthHandler) ListIdentities(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	user, err := h.dbService.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "User not found",
+		})
+		return
+	}
+
+	identities, err := h.dbService.GetUserIdentities(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to load linked accounts",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"identities":   identities,
+		"has_password": user.Password != "",
+	})
+}
+
+// LinkIdentity links the provider account behind the given token to the
+// signed-in user. A linked provider can sign in, so the user has to
+// re-authenticate first.
+func (h *AuthHandler) LinkIdentity(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Provider token required",
+		})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	provider := c.Param("provider")
+
+	user, err := h.dbService.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "User not found",
+		})
+		return
+	}
+
+	if !h.reauthenticate(c, user, req.Password, req.Code) {
+		return
+	}
+
+	profile := h.verifyProviderToken(c, provider, req.Token)
+	if profile == nil {
+		return
+	}
+	name := providerNames[provider]
+
+	if existing, err := h.dbService.GetUserIdentity(provider, profile.Subject); err == nil {
+		if existing.UserID == userID {
+			c.JSON(http.StatusOK, gin.H{
+				"success":  true,
+				"message":  name + " account is already linked",
+				"identity": existing,
+			})
+			return
+		}
+
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"message": "This " + name + " account is linked to another user",
+		})
+		return
+	}
+
+	identities, err := h.dbService.GetUserIdentities(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to link account",
+		})
+		return
+	}
+	for _, identity := range identities {
+		if identity.Provider == provider {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"message": "A different " + name + " account is already linked. Unlink it first.",
+			})
+			return
+		}
+	}
+
+	identity := &models.UserIdentity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  profile.Subject,
+		Email:    profile.Email,
+	}
+	if err := h.dbService.CreateUserIdentity(identity); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to link account",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":  true,
+		"message":  name + " account linked",
+		"identity": identity,
+	})
+}
+
+// UnlinkIdentity removes a linked provider, unless it is the user's only
+// remaining way to sign in.
+func (h *AuthHandler) UnlinkIdentity(c *gin.Context) {
+	userID := c.GetString("user_id")
+	provider := c.Param("provider")
+
+	name, ok := providerNames[provider]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "Unknown login provider",
+		})
+		return
+	}
+
+	deleted, err := h.dbService.DeleteUserIdentity(userID, provider)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to unlink account",
+		})
+		return
+	}
+
+	if !deleted {
+		// Either nothing was linked or it's the last login method
+		identities, err := h.dbService.GetUserIdentities(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"message": "Failed to unlink account",
+			})
+			return
+		}
+		for _, identity := range identities {
+			if identity.Provider == provider {
+				c.JSON(http.StatusConflict, gin.H{
+					"success": false,
+					"message": "You can't remove your only way to sign in. Set a password or link another account first.",
+				})
+				return
+			}
+		}
+
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "No " + name + " account is linked",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": name + " account unlinked",
+	})
+}
+
+// SetPassword lets a user who signed up through a provider add a password.
+// Accounts that already have one are refused. A password unlocks every other
+// account change, so the user has to re-authenticate first.
+func (h *AuthHandler) SetPassword(c *gin.Context) {
+	var req struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Invalid request data: " + err.Error(),
+		})
+		return
+	}
+
+	user, err := h.dbService.GetUserByID(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "User not found",
+		})
+		return
+	}
+
+	if user.Password != "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"message": "A password is already set for this account",
+		})
+		return
+	}
+
+	if !h.reauthenticate(c, user, "", req.Code) {
+		return
+	}
+
+	if violations := h.authService.ValidatePassword(req.Password, c.GetString("email"), c.GetString("username")); len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Password does not meet the requirements",
+			"errors":  violations,
+		})
+		return
+	}
+
+	hashedPassword, err := h.authService.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to process password",
+		})
+		return
+	}
+
+	updated, err := h.dbService.SetInitialPassword(c.GetString("user_id"), hashedPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to set password",
+		})
+		return
+	}
+
+	if !updated {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"message": "A password is already set for this account",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Password set successfully",
+	})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/services"
+)
+
+// RequestMagicLink emails a single-use sign-in link. The response is the
+// same whether or not the account exists, is inactive or is rate limited,
+// so it can't be used to probe for accounts.
+func (h *AuthHandler) RequestMagicLink(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid email address",
+		})
+		return
+	}
+
+	const genericMessage = "If an account with this email exists, a sign-in link has been sent."
+
+	user, err := h.dbService.GetUserByEmail(req.Email)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusOK, AuthResponse{
+			Success: true,
+			Message: genericMessage,
+		})
+		return
+	}
+
+	// Same cooldown and daily limit as verification emails
+	retryAfter, err := h.emailRetryAfter(user.ID, services.TokenPurposeMagicLink)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process sign-in link request",
+		})
+		return
+	}
+	if retryAfter > 0 {
+		c.JSON(http.StatusOK, AuthResponse{
+			Success: true,
+			Message: genericMessage,
+		})
+		return
+	}
+
+	token, err := h.authService.IssueToken(user.ID, services.TokenPurposeMagicLink, services.MagicLinkTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process sign-in link request",
+		})
+		return
+	}
+
+	if err := h.emailService.SendMagicLinkEmail(user, token, services.MagicLinkTokenTTL); err != nil {
+		log.Printf("Failed to send sign-in link to user %s: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Success: true,
+		Message: genericMessage,
+	})
+}
+
+// ConsumeMagicLink redeems a sign-in link and logs the user in exactly as
+// /auth/login would, including the 2FA step.
+func (h *AuthHandler) ConsumeMagicLink(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Sign-in token required",
+		})
+		return
+	}
+
+	userID, err := h.authService.ConsumeToken(services.TokenPurposeMagicLink, req.Token)
+	if errors.Is(err, services.ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid or expired sign-in link",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to sign in",
+		})
+		return
+	}
+
+	user, err := h.dbService.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid or expired sign-in link",
+		})
+		return
+	}
+
+	if !user.IsActive {
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Account is deactivated",
+		})
+		return
+	}
+
+	// Opening the link proves the user owns the address, so it verifies an
+	// unverified email just like a verification link would
+	if !user.IsVerified {
+		if err := h.dbService.MarkEmailAsVerified(user.ID); err != nil {
+			log.Printf("Failed to mark email verified for user %s: %v", user.ID, err)
+		} else {
+			user.IsVerified = true
+			h.dbService.ExpireUserAuthTokens(user.ID, services.TokenPurposeEmailVerification)
+		}
+	}
+
+	h.completeLogin(c, user)
+}
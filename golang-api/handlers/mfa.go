@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/services"
+)
+
+// MFAStatus reports whether 2FA is enabled and how many recovery codes are
+// left.
+func (h *AuthHandler) MFAStatus(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	enabled, err := h.dbService.IsTOTPEnabled(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to load two-factor status",
+		})
+		return
+	}
+
+	remaining := 0
+	if enabled {
+		if remaining, err = h.dbService.CountUnusedRecoveryCodes(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"message": "Failed to load two-factor status",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":                  true,
+		"enabled":                  enabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollTOTP starts 2FA enrollment with a fresh secret. It only takes effect
+// once ConfirmTOTP sees a valid code for it.
+func (h *AuthHandler) EnrollTOTP(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	secret, err := services.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to start two-factor enrollment",
+		})
+		return
+	}
+
+	saved, err := h.dbService.SavePendingTOTP(userID, secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to start two-factor enrollment",
+		})
+		return
+	}
+
+	if !saved {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"message": "Two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"message":     "Scan the QR code with your authenticator app, then confirm with a code",
+		"secret":      secret,
+		"otpauth_uri": services.TOTPProvisioningURI(secret, c.GetString("email")),
+	})
+}
+
+// ConfirmTOTP enables 2FA once the user proves their authenticator works and
+// returns the recovery codes. They are only ever shown here.
+func (h *AuthHandler) ConfirmTOTP(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Verification code required",
+		})
+		return
+	}
+
+	userID := c.GetString("user_id")
+
+	totp, err := h.dbService.GetUserTOTP(userID)
+	if err != nil || totp.EnabledAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "No two-factor enrollment is pending",
+		})
+		return
+	}
+
+	step, ok := services.MatchTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Invalid verification code",
+		})
+		return
+	}
+
+	codes, hashes, err := services.GenerateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to enable two-factor authentication",
+		})
+		return
+	}
+
+	if err := h.dbService.EnableTOTP(userID, step, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to enable two-factor authentication",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "Two-factor authentication enabled. Store your recovery codes somewhere safe.",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP turns 2FA off. It takes a current code (or a recovery code) so
+// a stolen session alone can't remove the second factor.
+func (h *AuthHandler) DisableTOTP(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Verification code required",
+		})
+		return
+	}
+
+	userID := c.GetString("user_id")
+
+	valid, err := h.authService.VerifySecondFactor(userID, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to disable two-factor authentication",
+		})
+		return
+	}
+
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Invalid verification code",
+		})
+		return
+	}
+
+	if err := h.dbService.DisableTOTP(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to disable two-factor authentication",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// VerifyMFA finishes a two-step login: it redeems the challenge token from
+// the first step together with a TOTP or recovery code. The challenge is
+// single-use, so a wrong code means signing in again.
+func (h *AuthHandler) VerifyMFA(c *gin.Context) {
+	var req struct {
+		ChallengeToken string `json:"challenge_token" binding:"required"`
+		Code           string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Challenge token and code required",
+		})
+		return
+	}
+
+	userID, err := h.authService.ConsumeToken(services.TokenPurposeMFAChallenge, req.ChallengeToken)
+	if errors.Is(err, services.ErrInvalidToken) {
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Invalid or expired challenge. Please sign in again.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to verify code",
+		})
+		return
+	}
+
+	valid, err := h.authService.VerifySecondFactor(userID, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to verify code",
+		})
+		return
+	}
+
+	user, err := h.dbService.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	if !valid {
+		// A wrong second factor counts towards the account's lockout just
+		// like a wrong password
+		if _, err := h.throttle.LoginFailed(c.ClientIP(), services.LoginAccount(user), user.ID); err != nil {
+			log.Printf("Failed to record failed login: %v", err)
+		}
+
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Invalid verification code. Please sign in again.",
+		})
+		return
+	}
+
+	if !user.IsActive {
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Account is deactivated",
+		})
+		return
+	}
+
+	h.respondWithTokens(c, user)
+}
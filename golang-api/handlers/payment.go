@@ -1,8 +1,16 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,31 +20,45 @@ import (
 )
 
 type PaymentHandler struct {
-	chapaService  *services.ChapaService
+	gateways      *services.PaymentGateways
 	dbService     *services.DatabaseService
 	hasuraService *services.HasuraService
+	emailService  *services.EmailService
 }
 
-func NewPaymentHandler(chapaService *services.ChapaService, dbService *services.DatabaseService, hasuraService *services.HasuraService) *PaymentHandler {
+func NewPaymentHandler(gateways *services.PaymentGateways, dbService *services.DatabaseService, hasuraService *services.HasuraService, emailService *services.EmailService) *PaymentHandler {
 	return &PaymentHandler{
-		chapaService:  chapaService,
+		gateways:      gateways,
 		dbService:     dbService,
 		hasuraService: hasuraService,
+		emailService:  emailService,
 	}
 }
 
+// InitializePaymentRequest names the recipe to buy and, optionally, the
+// payment provider; the default provider is used when it is empty. The price
+// always comes from the recipe, never from the client.
 type InitializePaymentRequest struct {
-	RecipeID string  `json:"recipe_id" binding:"required"`
-	Amount   float64 `json:"amount" binding:"required,gt=0"`
+	RecipeID      string `json:"recipe_id" binding:"required"`
+	PaymentMethod string `json:"payment_method"`
 }
 
 type PaymentResponse struct {
-	Success     bool   `json:"success"`
-	Message     string `json:"message"`
-	CheckoutURL string `json:"checkout_url,omitempty"`
-	TxRef       string `json:"tx_ref,omitempty"`
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	CheckoutURL  string `json:"checkout_url,omitempty"`
+	TxRef        string `json:"tx_ref,omitempty"`
+	AlreadyOwned bool   `json:"already_owned,omitempty"`
 }
 
+// pendingCheckoutTTL is how long a started checkout is handed out again
+// instead of starting a new one.
+const pendingCheckoutTTL = 30 * time.Minute
+
+// pendingCheckoutRetry is how long to wait for a checkout another request is
+// still starting.
+const pendingCheckoutRetry = 5 * time.Second
+
 func (h *PaymentHandler) InitializePayment(c *gin.Context) {
 	var req InitializePaymentRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -47,6 +69,15 @@ func (h *PaymentHandler) InitializePayment(c *gin.Context) {
 		return
 	}
 
+	gateway, ok := h.gateways.Get(req.PaymentMethod)
+	if !ok {
+		c.JSON(http.StatusBadRequest, PaymentResponse{
+			Success: false,
+			Message: "Unsupported payment method",
+		})
+		return
+	}
+
 	// Get user from context (set by auth middleware)
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -67,25 +98,127 @@ func (h *PaymentHandler) InitializePayment(c *gin.Context) {
 		return
 	}
 
+	recipe, err := h.dbService.GetRecipeByID(req.RecipeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, PaymentResponse{
+			Success: false,
+			Message: "Recipe not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, PaymentResponse{
+			Success: false,
+			Message: "Failed to get recipe details",
+		})
+		return
+	}
+
+	if recipe.Status != "published" || !recipe.IsPremium || recipe.Price <= 0 {
+		c.JSON(http.StatusBadRequest, PaymentResponse{
+			Success: false,
+			Message: "This recipe is not for sale",
+		})
+		return
+	}
+
+	// Retrying with the same Idempotency-Key gets the original purchase back
+	idempotencyKey := strings.TrimSpace(c.GetHeader("Idempotency-Key"))
+	if len(idempotencyKey) > 255 {
+		c.JSON(http.StatusBadRequest, PaymentResponse{
+			Success: false,
+			Message: "Idempotency-Key is too long",
+		})
+		return
+	}
+	if idempotencyKey != "" {
+		existing, err := h.dbService.GetRecipePurchaseByIdempotencyKey(user.ID, idempotencyKey)
+		if err == nil {
+			h.respondWithExistingPurchase(c, existing, recipe.ID, true)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, PaymentResponse{
+				Success: false,
+				Message: "Failed to check existing purchases",
+			})
+			return
+		}
+	}
+
+	if owned, err := h.dbService.GetCompletedRecipePurchase(user.ID, recipe.ID); err == nil {
+		h.respondWithExistingPurchase(c, owned, recipe.ID, false)
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, PaymentResponse{
+			Success: false,
+			Message: "Failed to check existing purchases",
+		})
+		return
+	}
+
+	// A checkout started with another provider is left alone; the user has
+	// chosen to pay differently
+	if pending, err := h.dbService.GetPendingRecipePurchase(user.ID, recipe.ID, pendingCheckoutTTL); err == nil && pending.PaymentMethod == gateway.Name() {
+		h.respondWithExistingPurchase(c, pending, recipe.ID, false)
+		return
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, PaymentResponse{
+			Success: false,
+			Message: "Failed to check existing purchases",
+		})
+		return
+	}
+
 	// Generate unique transaction reference
 	txRef := fmt.Sprintf("recipe_%s_%d", uuid.New().String()[:8], time.Now().Unix())
 
+	// Record the purchase before contacting the provider, so a concurrent
+	// request with the same Idempotency-Key can't start a second transaction
+	purchase := &models.RecipePurchase{
+		RecipeID:         recipe.ID,
+		UserID:           user.ID,
+		Amount:           recipe.Price, // price at the time of purchase
+		PaymentMethod:    gateway.Name(),
+		PaymentReference: txRef,
+		Status:           "pending",
+		IdempotencyKey:   idempotencyKey,
+	}
+
+	if err := h.dbService.CreateRecipePurchase(purchase); errors.Is(err, services.ErrIdempotencyKeyInUse) {
+		c.JSON(http.StatusConflict, PaymentResponse{
+			Success: false,
+			Message: "A request with this Idempotency-Key is already in progress",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, PaymentResponse{
+			Success: false,
+			Message: "Failed to create purchase record",
+		})
+		return
+	}
+
 	// Create payment request
 	paymentReq := &services.PaymentRequest{
-		Amount:      req.Amount,
+		Amount:      recipe.Price,
 		Currency:    "ETB", // Ethiopian Birr
 		Email:       user.Email,
+		PhoneNumber: user.Phone,
 		FirstName:   user.FirstName,
 		LastName:    user.LastName,
 		TxRef:       txRef,
-		CallbackURL: "http://localhost:8000/payment/webhook",
-		ReturnURL:   "http://localhost:3000/payment/success",
-		Description: fmt.Sprintf("Purchase recipe - %s", req.RecipeID),
+		CallbackURL: h.gateways.WebhookURL(gateway.Name()),
+		ReturnURL:   h.gateways.ReturnURL(),
+		Description: fmt.Sprintf("Purchase recipe - %s", recipe.Title),
 	}
 
-	// Initialize payment with Chapa
-	paymentResp, err := h.chapaService.InitializePayment(paymentReq)
+	checkoutURL, err := gateway.Initialize(paymentReq)
 	if err != nil {
+		// Nothing was charged; drop the record so the key can be retried
+		if err := h.dbService.DeleteRecipePurchase(purchase.ID); err != nil {
+			log.Printf("Failed to delete purchase %s: %v", purchase.ID, err)
+		}
 		c.JSON(http.StatusInternalServerError, PaymentResponse{
 			Success: false,
 			Message: "Failed to initialize payment: " + err.Error(),
@@ -93,32 +226,68 @@ func (h *PaymentHandler) InitializePayment(c *gin.Context) {
 		return
 	}
 
-	// Save purchase record
-	purchase := &models.RecipePurchase{
-		RecipeID:         req.RecipeID,
-		UserID:           userID.(string),
-		Amount:           req.Amount,
-		PaymentMethod:    "chapa",
-		PaymentReference: txRef,
-		Status:           "pending",
-	}
-
-	if err := h.dbService.CreateRecipePurchase(purchase); err != nil {
-		c.JSON(http.StatusInternalServerError, PaymentResponse{
-			Success: false,
-			Message: "Failed to create purchase record",
-		})
-		return
+	if err := h.dbService.SetRecipePurchaseCheckout(purchase.ID, checkoutURL); err != nil {
+		log.Printf("Failed to save checkout URL for purchase %s: %v", purchase.ID, err)
 	}
 
 	c.JSON(http.StatusOK, PaymentResponse{
 		Success:     true,
 		Message:     "Payment initialized successfully",
-		CheckoutURL: paymentResp.Data.CheckoutURL,
+		CheckoutURL: checkoutURL,
 		TxRef:       txRef,
 	})
 }
 
+// respondWithExistingPurchase answers an initialize request that matches a
+// purchase the user already has, instead of starting another transaction.
+// byKey tells whether the purchase was found by the request's Idempotency-Key
+// or matched by user and recipe alone.
+func (h *PaymentHandler) respondWithExistingPurchase(c *gin.Context, purchase *models.RecipePurchase, recipeID string, byKey bool) {
+	if purchase.RecipeID != recipeID {
+		c.JSON(http.StatusUnprocessableEntity, PaymentResponse{
+			Success: false,
+			Message: "This Idempotency-Key was used for a different recipe",
+		})
+		return
+	}
+
+	switch {
+	case purchase.Status == "completed":
+		c.JSON(http.StatusOK, PaymentResponse{
+			Success:      true,
+			Message:      "You already own this recipe",
+			TxRef:        purchase.PaymentReference,
+			AlreadyOwned: true,
+		})
+	case purchase.Status == "pending" && purchase.CheckoutURL != "":
+		c.JSON(http.StatusOK, PaymentResponse{
+			Success:     true,
+			Message:     "Payment already initialized",
+			CheckoutURL: purchase.CheckoutURL,
+			TxRef:       purchase.PaymentReference,
+		})
+	case purchase.Status == "pending" && byKey:
+		c.JSON(http.StatusConflict, PaymentResponse{
+			Success: false,
+			Message: "A request with this Idempotency-Key is already in progress",
+		})
+	case purchase.Status == "pending":
+		// Another request is still starting this checkout; its URL will be
+		// handed out shortly
+		setRetryAfter(c, pendingCheckoutRetry)
+		c.JSON(http.StatusTooManyRequests, PaymentResponse{
+			Success: false,
+			Message: "A checkout for this recipe is already being started. Please try again in a moment.",
+		})
+	default:
+		c.JSON(http.StatusOK, PaymentResponse{
+			Success: false,
+			Message: fmt.Sprintf("Payment %s", purchase.Status),
+			TxRef:   purchase.PaymentReference,
+		})
+	}
+}
+
 func (h *PaymentHandler) VerifyPayment(c *gin.Context) {
 	var req struct {
 		TxRef string `json:"tx_ref" binding:"required"`
@@ -132,92 +301,206 @@ func (h *PaymentHandler) VerifyPayment(c *gin.Context) {
 		return
 	}
 
-	// Verify payment with Chapa
-	verifyResp, err := h.chapaService.VerifyPayment(req.TxRef)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, PaymentResponse{
+	// Get purchase record; other users' purchases look the same as missing ones
+	purchase, err := h.dbService.GetRecipePurchaseByReference(req.TxRef)
+	if err != nil || purchase.UserID != c.GetString("user_id") {
+		c.JSON(http.StatusNotFound, PaymentResponse{
 			Success: false,
-			Message: "Failed to verify payment: " + err.Error(),
+			Message: "Purchase record not found",
 		})
 		return
 	}
 
-	// Get purchase record
-	purchase, err := h.dbService.GetRecipePurchaseByReference(req.TxRef)
-	if err != nil {
-		c.JSON(http.StatusNotFound, PaymentResponse{
+	// Verify with the provider the purchase was started with
+	gateway, ok := h.gateways.Get(purchase.PaymentMethod)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, PaymentResponse{
 			Success: false,
-			Message: "Purchase record not found",
+			Message: "Payment provider " + purchase.PaymentMethod + " is not available",
 		})
 		return
 	}
 
-	// Update purchase status based on verification result
-	var status string
-	if verifyResp.Data.Status == "success" {
-		status = "completed"
-	} else {
-		status = "failed"
+	result, err := h.settlePurchase(gateway, purchase)
+	if errors.Is(err, services.ErrAlreadyPurchased) {
+		message := "You already own this recipe"
+		if purchase.Status == "refunded" {
+			message = "You already own this recipe, so this payment has been refunded"
+		}
+		c.JSON(http.StatusOK, PaymentResponse{
+			Success:      true,
+			Message:      message,
+			AlreadyOwned: true,
+		})
+		return
 	}
-
-	if err := h.dbService.UpdateRecipePurchaseStatus(purchase.ID, status); err != nil {
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, PaymentResponse{
 			Success: false,
-			Message: "Failed to update purchase status",
+			Message: "Failed to verify payment: " + err.Error(),
 		})
 		return
 	}
 
+	message := fmt.Sprintf("Payment %s", result.Status)
+	if result.Status == services.PaymentSucceeded && purchase.Status == "failed" {
+		message = "Payment amount does not match the recipe price"
+	}
+
 	c.JSON(http.StatusOK, PaymentResponse{
-		Success: verifyResp.Data.Status == "success",
-		Message: fmt.Sprintf("Payment %s", verifyResp.Data.Status),
+		Success: purchase.Status == "completed",
+		Message: message,
+		TxRef:   purchase.PaymentReference,
 	})
 }
 
+// maxWebhookBody bounds how much of a webhook delivery is read.
+const maxWebhookBody = 1 << 20
+
+// WebhookHandler handles a provider's server-to-server notifications at
+// /payment/webhook/:provider. It sits outside user auth: a delivery is
+// trusted only if the provider's signature checks out, and each delivery is
+// processed once.
 func (h *PaymentHandler) WebhookHandler(c *gin.Context) {
-	// Handle Chapa webhook notifications
-	var webhookData map[string]interface{}
-	if err := c.ShouldBindJSON(&webhookData); err != nil {
+	// The original webhook URL, still configured in the Chapa dashboard,
+	// has no provider in it
+	name := c.Param("provider")
+	if name == "" {
+		name = "chapa"
+	}
+
+	gateway, ok := h.gateways.Get(name)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown payment provider"})
+		return
+	}
+
+	// Signatures cover the exact bytes the provider sent, so read them before
+	// any decoding
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBody+1))
+	if err != nil || len(body) > maxWebhookBody {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook data"})
 		return
 	}
 
-	// Extract transaction reference
-	txRef, ok := webhookData["tx_ref"].(string)
-	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing transaction reference"})
+	event, err := gateway.ParseWebhook(c.Request.Header, body)
+	switch {
+	case errors.Is(err, services.ErrWebhookNotConfigured):
+		log.Printf("Rejected %s webhook: no webhook secret is configured", name)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Webhook not configured"})
+		return
+	case errors.Is(err, services.ErrInvalidWebhookSignature):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook data"})
 		return
 	}
 
-	// Verify the webhook with Chapa
-	verifyResp, err := h.chapaService.VerifyPayment(txRef)
+	// A signed delivery can be captured and sent again; only the first copy
+	// is processed
+	sum := sha256.Sum256(body)
+	deliveryHash := hex.EncodeToString(sum[:])
+	claimed, err := h.dbService.ClaimWebhookDelivery(name, deliveryHash, event.Reference)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify payment"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record webhook"})
+		return
+	}
+	if !claimed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Delivery already processed"})
 		return
 	}
 
-	// Get purchase record
-	purchase, err := h.dbService.GetRecipePurchaseByReference(txRef)
-	if err != nil {
+	// Let the provider's retry through if this delivery isn't fully processed
+	processed := false
+	defer func() {
+		if !processed {
+			if err := h.dbService.ReleaseWebhookDelivery(name, deliveryHash); err != nil {
+				log.Printf("Failed to release webhook delivery for %s: %v", event.Reference, err)
+			}
+		}
+	}()
+
+	// Get purchase record; a provider can only settle its own purchases
+	purchase, err := h.dbService.GetRecipePurchaseByReference(event.Reference)
+	if err != nil || purchase.PaymentMethod != name {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase record not found"})
 		return
 	}
 
-	// Update purchase status
-	var status string
-	if verifyResp.Data.Status == "success" {
+	_, err = h.settlePurchase(gateway, purchase)
+	if errors.Is(err, services.ErrAlreadyPurchased) {
+		// Until the refund is recorded the provider has to retry, or the
+		// money is never returned
+		if purchase.Status != "refunded" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund duplicate payment"})
+			return
+		}
+		processed = true
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate purchase"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify payment"})
+		return
+	}
+
+	processed = true
+	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+}
+
+// settlePurchase asks the purchase's provider how the payment went and
+// records the outcome on purchase. A payment still pending leaves the
+// purchase as it is, and a completed purchase stays completed. The receipt
+// and the Hasura event go out only from the call that completed it. Paying
+// for a recipe the buyer already owns returns ErrAlreadyPurchased; the
+// purchase is refunded if its status ends up "refunded".
+func (h *PaymentHandler) settlePurchase(gateway services.PaymentGateway, purchase *models.RecipePurchase) (*services.PaymentResult, error) {
+	result, err := gateway.Verify(purchase.PaymentReference)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status == services.PaymentPending {
+		return result, nil
+	}
+
+	status := "failed"
+	if paidInFull(result, purchase) {
 		status = "completed"
-	} else {
-		status = "failed"
 	}
 
-	if err := h.dbService.UpdateRecipePurchaseStatus(purchase.ID, status); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
-		return
+	changed, err := h.dbService.UpdateRecipePurchaseStatus(purchase.ID, status)
+	if errors.Is(err, services.ErrAlreadyPurchased) {
+		// A second checkout of an owned recipe was paid; nothing to unlock,
+		// so the money goes back
+		if err := h.refundDuplicate(gateway, purchase, result); err != nil {
+			return result, fmt.Errorf("%w, and the refund failed: %v", services.ErrAlreadyPurchased, err)
+		}
+		return result, services.ErrAlreadyPurchased
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// If payment successful, trigger Hasura event
+	if !changed {
+		// Already settled, possibly by a concurrent verify or webhook; report
+		// what is stored
+		current, err := h.dbService.GetRecipePurchaseByReference(purchase.PaymentReference)
+		if err != nil {
+			return nil, err
+		}
+		purchase.Status = current.Status
+		if current.Status == "refunded" {
+			return result, services.ErrAlreadyPurchased
+		}
+		return result, nil
+	}
+
+	purchase.Status = status
+
 	if status == "completed" {
+		h.sendReceipt(purchase)
+
 		// Trigger recipe purchase event in Hasura
 		h.hasuraService.TriggerEvent("recipe_purchased", map[string]interface{}{
 			"user_id":   purchase.UserID,
@@ -226,5 +509,63 @@ func (h *PaymentHandler) WebhookHandler(c *gin.Context) {
 		})
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+	return result, nil
+}
+
+// refundDuplicate refunds a payment for a recipe the buyer already owned and
+// marks the purchase refunded. If the provider refuses, the purchase is left
+// as it is, so the next verify or webhook retry tries again, and the failure
+// is raised as a purchase_refund_failed event for someone to follow up.
+func (h *PaymentHandler) refundDuplicate(gateway services.PaymentGateway, purchase *models.RecipePurchase, result *services.PaymentResult) error {
+	if err := gateway.Refund(purchase.PaymentReference, result.Amount, "Recipe already purchased"); err != nil {
+		log.Printf("Purchase %s was paid but the recipe was already owned, and the refund failed: %v", purchase.ID, err)
+		h.hasuraService.TriggerEvent("purchase_refund_failed", map[string]interface{}{
+			"purchase_id": purchase.ID,
+			"user_id":     purchase.UserID,
+			"recipe_id":   purchase.RecipeID,
+			"amount":      result.Amount,
+			"error":       err.Error(),
+		})
+		return err
+	}
+
+	if _, err := h.dbService.UpdateRecipePurchaseStatus(purchase.ID, "refunded"); err != nil {
+		log.Printf("Refunded purchase %s but failed to record it: %v", purchase.ID, err)
+		return err
+	}
+	purchase.Status = "refunded"
+	log.Printf("Refunded purchase %s of a recipe the user already owned", purchase.ID)
+	return nil
+}
+
+// paidInFull reports whether the provider confirmed a successful payment of
+// the price recorded on the purchase.
+func paidInFull(result *services.PaymentResult, purchase *models.RecipePurchase) bool {
+	return result.Status == services.PaymentSucceeded &&
+		strings.EqualFold(result.Currency, "ETB") &&
+		math.Abs(result.Amount-purchase.Amount) < 0.005
+}
+
+// sendReceipt emails the buyer a receipt. Failures are only logged because
+// the purchase itself has already been recorded.
+func (h *PaymentHandler) sendReceipt(purchase *models.RecipePurchase) {
+	user, err := h.dbService.GetUserByID(purchase.UserID)
+	if err != nil {
+		log.Printf("Failed to load buyer for purchase %s: %v", purchase.ID, err)
+		return
+	}
+	if user.Email == "" {
+		// Signed up by phone and hasn't added an email yet
+		return
+	}
+
+	recipe, err := h.dbService.GetRecipeByID(purchase.RecipeID)
+	if err != nil {
+		log.Printf("Failed to load recipe for purchase %s: %v", purchase.ID, err)
+		return
+	}
+
+	if err := h.emailService.SendPurchaseReceipt(user, recipe, purchase); err != nil {
+		log.Printf("Failed to send receipt for purchase %s: %v", purchase.ID, err)
+	}
 }
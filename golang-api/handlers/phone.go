@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/models"
+	"recipehub/services"
+)
+
+// RequestPhoneOTP texts a 6-digit code to the given number. The same code
+// signs in (or signs up) at /auth/phone/verify, or adds the number to the
+// account of a signed-in user.
+func (h *AuthHandler) RequestPhoneOTP(c *gin.Context) {
+	var req struct {
+		Phone string `json:"phone" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Phone number required",
+		})
+		return
+	}
+
+	phone, err := services.NormalizePhone(req.Phone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid phone number",
+		})
+		return
+	}
+
+	retryAfter, err := h.throttle.AllowPhoneOTP(c.ClientIP(), phone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to send code",
+		})
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(c, retryAfter)
+		c.JSON(http.StatusTooManyRequests, AuthResponse{
+			Success: false,
+			Message: "Please wait before requesting another code",
+		})
+		return
+	}
+
+	code, err := h.authService.IssuePhoneOTP(phone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to send code",
+		})
+		return
+	}
+
+	err = h.smsSender.Send(&services.SMS{
+		To:   phone,
+		Body: code + " is your RecipeHub code. It expires in 5 minutes. Don't share it with anyone.",
+	})
+	if err != nil {
+		log.Printf("Failed to send SMS code to %s: %v", phone, err)
+		c.JSON(http.StatusBadGateway, AuthResponse{
+			Success: false,
+			Message: "Failed to send code",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Success: true,
+		Message: "Code sent to " + phone,
+	})
+}
+
+// VerifyPhoneOTP redeems a code. Signed-in users get the number attached to
+// their account; otherwise it logs in the account with that number, creating
+// one on first use, and responds like /auth/login.
+func (h *AuthHandler) VerifyPhoneOTP(c *gin.Context) {
+	var req struct {
+		Phone string `json:"phone" binding:"required"`
+		Code  string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Phone number and code required",
+		})
+		return
+	}
+
+	phone, err := services.NormalizePhone(req.Phone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Invalid phone number",
+		})
+		return
+	}
+
+	ok, err := h.authService.VerifyPhoneOTP(phone, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to verify code",
+		})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Invalid or expired code",
+		})
+		return
+	}
+
+	if userID := c.GetString("user_id"); userID != "" {
+		h.attachPhone(c, userID, phone)
+		return
+	}
+
+	user, err := h.dbService.GetUserByPhone(phone)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = h.createPhoneUser(phone)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to sign in",
+		})
+		return
+	}
+
+	if !user.IsActive {
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Account is deactivated",
+		})
+		return
+	}
+
+	h.completeLogin(c, user)
+}
+
+func (h *AuthHandler) attachPhone(c *gin.Context, userID, phone string) {
+	updated, err := h.dbService.SetUserPhone(userID, phone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to add phone number",
+		})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusConflict, AuthResponse{
+			Success: false,
+			Message: "This phone number belongs to another account",
+		})
+		return
+	}
+
+	user, err := h.dbService.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to add phone number",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Success: true,
+		Message: "Phone number verified",
+		User:    user,
+	})
+}
+
+// createPhoneUser signs up the owner of a verified number. The account has
+// no email or password until they add one.
+func (h *AuthHandler) createPhoneUser(phone string) (*models.User, error) {
+	username, err := h.availableUsername("user" + phone[len(phone)-4:])
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Phone:    phone,
+		Username: username,
+	}
+	if err := h.dbService.CreateUserWithPhone(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
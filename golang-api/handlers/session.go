@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"recipehub/services"
+)
+
+// Logout revokes the access token used for the request and ends its session,
+// which also invalidates the session's refresh token.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	claims := c.MustGet("claims").(*services.Claims)
+
+	if err := h.authService.RevokeToken(claims); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to revoke token",
+		})
+		return
+	}
+
+	if err := h.dbService.RevokeSession(claims.SessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to end session",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Logged out successfully",
+	})
+}
+
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	userID := c.GetString("user_id")
+	currentID := c.GetString("session_id")
+
+	sessions, err := h.dbService.GetActiveSessions(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to load sessions",
+		})
+		return
+	}
+
+	for _, session := range sessions {
+		session.Current = session.ID == currentID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"sessions": sessions,
+	})
+}
+
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	// Anything that isn't a UUID can't name a session, and would only make
+	// the uuid comparison in the query fail with a 500
+	sessionID := c.Param("id")
+	if _, err := uuid.Parse(sessionID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "Session not found",
+		})
+		return
+	}
+
+	revoked, err := h.dbService.RevokeUserSession(c.GetString("user_id"), sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to revoke session",
+		})
+		return
+	}
+
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "Session not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Session revoked",
+	})
+}
+
+func (h *AuthHandler) RevokeOtherSessions(c *gin.Context) {
+	revoked, err := h.dbService.RevokeOtherSessions(c.GetString("user_id"), c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "Failed to revoke sessions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Other sessions revoked",
+		"revoked": revoked,
+	})
+}
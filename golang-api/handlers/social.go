@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/models"
+	"recipehub/services"
+)
+
+const (
+	providerGoogle   = "google"
+	providerFacebook = "facebook"
+)
+
+var providerNames = map[string]string{
+	providerGoogle:   "Google",
+	providerFacebook: "Facebook",
+}
+
+// socialProfile is what a login provider tells us about the user once their
+// token has been verified.
+type socialProfile struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	Avatar        string
+}
+
+func (h *AuthHandler) GoogleLogin(c *gin.Context) {
+	var req struct {
+		GoogleToken string `json:"google_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Google token required",
+		})
+		return
+	}
+
+	if profile := h.verifyProviderToken(c, providerGoogle, req.GoogleToken); profile != nil {
+		h.socialLogin(c, profile)
+	}
+}
+
+func (h *AuthHandler) FacebookLogin(c *gin.Context) {
+	var req struct {
+		FacebookToken string `json:"facebook_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuthResponse{
+			Success: false,
+			Message: "Facebook token required",
+		})
+		return
+	}
+
+	if profile := h.verifyProviderToken(c, providerFacebook, req.FacebookToken); profile != nil {
+		h.socialLogin(c, profile)
+	}
+}
+
+// verifyProviderToken checks a token with the provider it claims to be from
+// and returns the profile behind it. On failure the error response has been
+// written and nil is returned.
+func (h *AuthHandler) verifyProviderToken(c *gin.Context, provider, token string) *socialProfile {
+	var profile *socialProfile
+	var err error
+	var notConfigured, invalid error
+
+	switch provider {
+	case providerGoogle:
+		notConfigured, invalid = services.ErrGoogleNotConfigured, services.ErrInvalidGoogleToken
+
+		// Verify the ID token locally against Google's signing keys
+		var google *services.GoogleProfile
+		if google, err = h.googleService.VerifyIDToken(token); err == nil {
+			profile = &socialProfile{
+				Subject:       google.Subject,
+				Email:         google.Email,
+				EmailVerified: google.EmailVerified,
+				FirstName:     google.FirstName,
+				LastName:      google.LastName,
+				Avatar:        google.Picture,
+			}
+		}
+	case providerFacebook:
+		notConfigured, invalid = services.ErrFacebookNotConfigured, services.ErrInvalidFacebookToken
+
+		// Introspect the token with the Graph API and load the profile
+		var facebook *services.FacebookProfile
+		if facebook, err = h.facebookService.VerifyAccessToken(token); err == nil {
+			// Facebook only hands out confirmed addresses
+			profile = &socialProfile{
+				Subject:       facebook.Subject,
+				Email:         facebook.Email,
+				EmailVerified: facebook.Email != "",
+				FirstName:     facebook.FirstName,
+				LastName:      facebook.LastName,
+				Avatar:        facebook.Picture,
+			}
+		}
+	default:
+		c.JSON(http.StatusNotFound, AuthResponse{
+			Success: false,
+			Message: "Unknown login provider",
+		})
+		return nil
+	}
+
+	name := providerNames[provider]
+	switch {
+	case err == nil:
+		profile.Provider = provider
+		return profile
+	case errors.Is(err, notConfigured):
+		c.JSON(http.StatusServiceUnavailable, AuthResponse{
+			Success: false,
+			Message: name + " login is not available",
+		})
+	case errors.Is(err, invalid):
+		log.Printf("Rejected %s token: %v", name, err)
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Invalid " + name + " token",
+		})
+	default:
+		log.Printf("%s token check failed: %v", name, err)
+		c.JSON(http.StatusBadGateway, AuthResponse{
+			Success: false,
+			Message: "Could not verify " + name + " token",
+		})
+	}
+	return nil
+}
+
+// socialLogin signs in the user linked to a verified provider profile, or
+// creates an account on first login, and responds like Login.
+//
+// An existing account is never taken over just because the email matches:
+// its owner has to sign in and link the provider themselves.
+func (h *AuthHandler) socialLogin(c *gin.Context, profile *socialProfile) {
+	name := providerNames[profile.Provider]
+
+	var user *models.User
+	identity, err := h.dbService.GetUserIdentity(profile.Provider, profile.Subject)
+	switch {
+	case err == nil:
+		user, err = h.dbService.GetUserByID(identity.UserID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, AuthResponse{
+				Success: false,
+				Message: "User not found",
+			})
+			return
+		}
+		h.dbService.TouchUserIdentity(identity.ID)
+
+	case errors.Is(err, sql.ErrNoRows):
+		if profile.Email == "" || !profile.EmailVerified {
+			c.JSON(http.StatusUnauthorized, AuthResponse{
+				Success: false,
+				Message: name + " account has no verified email address",
+			})
+			return
+		}
+
+		if existing, _ := h.dbService.GetUserByEmail(profile.Email); existing != nil {
+			c.JSON(http.StatusConflict, AuthResponse{
+				Success: false,
+				Message: "An account with this email already exists. Sign in and link " + name + " from your account settings.",
+			})
+			return
+		}
+
+		user, err = h.createSocialUser(profile)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, AuthResponse{
+				Success: false,
+				Message: "Failed to create user account",
+			})
+			return
+		}
+
+	default:
+		c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Message: "Failed to process " + name + " login",
+		})
+		return
+	}
+
+	// Check if user is active
+	if !user.IsActive {
+		c.JSON(http.StatusUnauthorized, AuthResponse{
+			Success: false,
+			Message: "Account is deactivated",
+		})
+		return
+	}
+
+	h.completeLogin(c, user)
+}
+
+// createSocialUser provisions an account for a first-time social login. It
+// has no password, so only social login works until one is set.
+func (h *AuthHandler) createSocialUser(profile *socialProfile) (*models.User, error) {
+	username, err := h.availableUsername(profile.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Email:     profile.Email,
+		Username:  username,
+		FirstName: profile.FirstName,
+		LastName:  profile.LastName,
+		Avatar:    profile.Avatar,
+	}
+	identity := &models.UserIdentity{
+		Provider: profile.Provider,
+		Subject:  profile.Subject,
+		Email:    profile.Email,
+	}
+
+	if err := h.dbService.CreateUserWithIdentity(user, identity); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// availableUsername derives a free username from the local part of email,
+// adding a random suffix when the plain one is taken.
+func (h *AuthHandler) availableUsername(email string) (string, error) {
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+
+	var base strings.Builder
+	for _, r := range local {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			base.WriteRune(r)
+		}
+	}
+
+	candidate := base.String()
+	if len(candidate) > 40 {
+		candidate = candidate[:40]
+	}
+	if len(candidate) < 3 {
+		candidate = "user" + candidate
+	}
+	prefix := candidate
+
+	for attempt := 0; attempt < 5; attempt++ {
+		if existing, _ := h.dbService.GetUserByUsername(candidate); existing == nil {
+			return candidate, nil
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s%06d", prefix, n.Int64())
+	}
+
+	return "", errors.New("no available username")
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -21,15 +23,51 @@ func main() {
 
 	// Initialize services
 	dbService := services.NewDatabaseService()
-	authService := services.NewAuthService()
+	revocationStore := services.NewRevocationStore(dbService)
+	authService := services.NewAuthService(dbService, revocationStore)
 	fileService := services.NewFileService()
-	chapaService := services.NewChapaService()
 	hasuraService := services.NewHasuraService()
+	emailService := services.NewEmailService(services.NewMailer())
+	googleService := services.NewGoogleService()
+	facebookService := services.NewFacebookService()
+	smsSender := services.NewSMSSender()
+	loginThrottle := services.NewLoginThrottle(services.NewAttemptStore(dbService), dbService)
+
+	// Payment providers. The fake gateway takes no money and must only be
+	// enabled in development and CI.
+	gateways := []services.PaymentGateway{services.NewChapaService()}
+	if services.TelebirrConfigured() {
+		gateways = append(gateways, services.NewTelebirrService())
+	}
+	var fakeGateway *services.FakeGateway
+	if os.Getenv("PAYMENT_FAKE_GATEWAY") == "true" {
+		fakeGateway = services.NewFakeGateway()
+		gateways = append(gateways, fakeGateway)
+		log.Println("Fake payment gateway enabled; payments through it are not real")
+	}
+	paymentGateways, err := services.NewPaymentGateways(os.Getenv("PAYMENT_DEFAULT_GATEWAY"), gateways...)
+	if err != nil {
+		log.Fatalf("Failed to configure payment gateways: %v", err)
+	}
+
+	// Reload JWT signing keys on SIGHUP so keys can be rotated without a restart
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			if err := authService.ReloadKeys(); err != nil {
+				log.Printf("Failed to reload JWT signing keys: %v", err)
+				continue
+			}
+			log.Println("JWT signing keys reloaded")
+		}
+	}()
 
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(authService, dbService, hasuraService)
+	authHandler := handlers.NewAuthHandler(authService, dbService, hasuraService, emailService, googleService, facebookService, loginThrottle, smsSender)
 	fileHandler := handlers.NewFileHandler(fileService)
-	paymentHandler := handlers.NewPaymentHandler(chapaService, dbService, hasuraService)
+	adminHandler := handlers.NewAdminHandler(dbService, loginThrottle)
+	paymentHandler := handlers.NewPaymentHandler(paymentGateways, dbService, hasuraService, emailService)
 
 	// Setup Gin router
 	r := gin.Default()
@@ -46,6 +84,9 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
 	})
 
+	// Public signing keys for Hasura's jwk_url
+	r.GET("/.well-known/jwks.json", authHandler.JWKS)
+
 	// Auth routes (Hasura Actions)
 	auth := r.Group("/auth")
 	{
@@ -55,8 +96,42 @@ func main() {
 		auth.POST("/forgot-password", authHandler.ForgotPassword)
 		auth.POST("/reset-password", authHandler.ResetPassword)
 		auth.POST("/verify-email", authHandler.VerifyEmail)
+		auth.POST("/resend-verification", middleware.OptionalAuthMiddleware(authService), authHandler.ResendVerification)
 		auth.POST("/google-login", authHandler.GoogleLogin)
 		auth.POST("/facebook-login", authHandler.FacebookLogin)
+		auth.POST("/logout", middleware.AuthMiddleware(authService), authHandler.Logout)
+		auth.POST("/set-password", middleware.AuthMiddleware(authService), authHandler.SetPassword)
+		auth.POST("/change-password", middleware.AuthMiddleware(authService), authHandler.ChangePassword)
+		auth.POST("/change-email", middleware.AuthMiddleware(authService), authHandler.ChangeEmail)
+		auth.POST("/confirm-email-change", authHandler.ConfirmEmailChange)
+		auth.POST("/magic-link/request", authHandler.RequestMagicLink)
+		auth.POST("/magic-link/consume", authHandler.ConsumeMagicLink)
+		auth.POST("/phone/request", authHandler.RequestPhoneOTP)
+		auth.POST("/phone/verify", middleware.OptionalAuthMiddleware(authService), authHandler.VerifyPhoneOTP)
+	}
+
+	// Session management
+	sessions := r.Group("/auth/sessions")
+	sessions.Use(middleware.AuthMiddleware(authService))
+	{
+		sessions.GET("", authHandler.ListSessions)
+		sessions.DELETE("/:id", authHandler.RevokeSession)
+		sessions.POST("/revoke-others", authHandler.RevokeOtherSessions)
+	}
+	mfa := r.Group("/auth/2fa")
+	{
+		mfa.POST("/verify", authHandler.VerifyMFA)
+		mfa.GET("", middleware.AuthMiddleware(authService), authHandler.MFAStatus)
+		mfa.POST("/enroll", middleware.AuthMiddleware(authService), authHandler.EnrollTOTP)
+		mfa.POST("/confirm", middleware.AuthMiddleware(authService), authHandler.ConfirmTOTP)
+		mfa.POST("/disable", middleware.AuthMiddleware(authService), authHandler.DisableTOTP)
+	}
+	identities := r.Group("/auth/identities")
+	identities.Use(middleware.AuthMiddleware(authService))
+	{
+		identities.GET("", authHandler.ListIdentities)
+		identities.POST("/:provider", authHandler.LinkIdentity)
+		identities.DELETE("/:provider", authHandler.UnlinkIdentity)
 	}
 
 	// File upload routes
@@ -68,13 +143,22 @@ func main() {
 		upload.DELETE("/image/:filename", fileHandler.DeleteImage)
 	}
 
+	// Payment providers call the webhook server to server; it is
+	// authenticated by its signature, not a user token. The bare path is
+	// Chapa's original webhook URL.
+	r.POST("/payment/webhook", paymentHandler.WebhookHandler)
+	r.POST("/payment/webhook/:provider", paymentHandler.WebhookHandler)
+
+	if fakeGateway != nil {
+		r.Any(services.FakeGatewayPath+"*path", gin.WrapH(fakeGateway))
+	}
+
 	// Payment routes (Hasura Actions)
 	payment := r.Group("/payment")
 	payment.Use(middleware.AuthMiddleware(authService))
 	{
 		payment.POST("/initialize", paymentHandler.InitializePayment)
 		payment.POST("/verify", paymentHandler.VerifyPayment)
-		payment.POST("/webhook", paymentHandler.WebhookHandler)
 	}
 
 	// Recipe actions
@@ -85,6 +169,18 @@ func main() {
 		recipe.POST("/recommend", handlers.GetRecommendations)
 	}
 
+	// Admin routes
+	admin := r.Group("/admin")
+	admin.Use(middleware.AuthMiddleware(authService))
+	{
+		admin.GET("/users/:id/roles", middleware.RequireRole(services.RoleAdmin), adminHandler.ListUserRoles)
+		admin.POST("/users/:id/roles", middleware.RequireRole(services.RoleAdmin), adminHandler.GrantRole)
+		admin.DELETE("/users/:id/roles/:role", middleware.RequireRole(services.RoleAdmin), adminHandler.RevokeRole)
+		admin.GET("/role-audit", middleware.RequireRole(services.RoleAdmin), adminHandler.RoleAuditLog)
+		admin.GET("/lockouts", middleware.RequireRole(services.RoleAdmin, services.RoleModerator), adminHandler.ListLockouts)
+		admin.POST("/lockouts/unlock", middleware.RequireRole(services.RoleAdmin, services.RoleModerator), adminHandler.UnlockAccount)
+	}
+
 	// Static file serving
 	r.Static("/uploads", "./uploads")
 
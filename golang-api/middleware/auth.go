@@ -30,7 +30,7 @@ func AuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
 			return
 		}
 
-		claims, err := authService.ValidateToken(tokenString)
+		claims, err := authService.Authenticate(tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"success": false,
@@ -44,6 +44,8 @@ func AuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("email", claims.Email)
+		c.Set("session_id", claims.SessionID)
+		c.Set("claims", claims)
 
 		c.Next()
 	}
@@ -55,11 +57,13 @@ func OptionalAuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
 		if authHeader != "" {
 			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 			if tokenString != authHeader {
-				claims, err := authService.ValidateToken(tokenString)
+				claims, err := authService.Authenticate(tokenString)
 				if err == nil {
 					c.Set("user_id", claims.UserID)
 					c.Set("username", claims.Username)
 					c.Set("email", claims.Email)
+					c.Set("session_id", claims.SessionID)
+					c.Set("claims", claims)
 				}
 			}
 		}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"recipehub/services"
+)
+
+// RequireRole lets the request through only if the access token grants at
+// least one of roles. It reads the claims set by AuthMiddleware, so it must
+// run after it.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get("claims")
+		claims, ok := value.(*services.Claims)
+		if !exists || !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"message": "Authentication required",
+			})
+			c.Abort()
+			return
+		}
+
+		for _, role := range roles {
+			if claims.HasRole(role) {
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"message": "You don't have permission to do this",
+		})
+		c.Abort()
+	}
+}
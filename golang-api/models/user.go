@@ -17,6 +17,8 @@ type User struct {
 	IsVerified      bool       `json:"is_verified" db:"is_verified"`
 	IsActive        bool       `json:"is_active" db:"is_active"`
 	EmailVerifiedAt *time.Time `json:"email_verified_at" db:"email_verified_at"`
+	Phone           string     `json:"phone,omitempty" db:"phone"`
+	PhoneVerifiedAt *time.Time `json:"phone_verified_at,omitempty" db:"phone_verified_at"`
 	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
 }
@@ -50,10 +52,103 @@ type RecipePurchase struct {
 	PaymentMethod    string    `json:"payment_method" db:"payment_method"`
 	PaymentReference string    `json:"payment_reference" db:"payment_reference"`
 	Status           string    `json:"status" db:"status"`
+	CheckoutURL      string    `json:"checkout_url,omitempty" db:"checkout_url"`
+	IdempotencyKey   string    `json:"-" db:"idempotency_key"`
 	CreatedAt        time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
 }
 
+type UserRole struct {
+	UserID    string    `json:"user_id" db:"user_id"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// RoleActor identifies who changed a role: a signed-in user (UserID set) or
+// an operator using the admin CLI.
+type RoleActor struct {
+	UserID string
+	Name   string
+}
+
+type RoleAuditEntry struct {
+	ID        string    `json:"id" db:"id"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	Role      string    `json:"role" db:"role"`
+	Action    string    `json:"action" db:"action"`
+	ActorID   string    `json:"actor_id,omitempty" db:"actor_id"`
+	Actor     string    `json:"actor" db:"actor"`
+	Reason    string    `json:"reason,omitempty" db:"reason"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type AuthToken struct {
+	ID        string    `json:"id" db:"id"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	Purpose   string    `json:"purpose" db:"purpose"`
+	Selector  string    `json:"-" db:"selector"`
+	TokenHash string    `json:"-" db:"token_hash"`
+	Payload   string    `json:"-" db:"payload"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type Session struct {
+	ID         string     `json:"id" db:"id"`
+	UserID     string     `json:"user_id" db:"user_id"`
+	UserAgent  string     `json:"user_agent" db:"user_agent"`
+	IPAddress  string     `json:"ip_address" db:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+	Current    bool       `json:"current" db:"-"`
+}
+
+type RefreshToken struct {
+	ID        string     `json:"id" db:"id"`
+	UserID    string     `json:"user_id" db:"user_id"`
+	FamilyID  string     `json:"family_id" db:"family_id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	RotatedAt *time.Time `json:"rotated_at" db:"rotated_at"`
+	RevokedAt *time.Time `json:"revoked_at" db:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// UserIdentity links a user to an account at an external login provider.
+type UserIdentity struct {
+	ID         string     `json:"id" db:"id"`
+	UserID     string     `json:"user_id" db:"user_id"`
+	Provider   string     `json:"provider" db:"provider"`
+	Subject    string     `json:"-" db:"subject"`
+	Email      string     `json:"email" db:"email"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+}
+
+// UserTOTP is a user's TOTP enrollment; it only counts once EnabledAt is set.
+type UserTOTP struct {
+	UserID       string     `json:"user_id" db:"user_id"`
+	Secret       string     `json:"-" db:"secret"`
+	EnabledAt    *time.Time `json:"enabled_at" db:"enabled_at"`
+	LastUsedStep int64      `json:"-" db:"last_used_step"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// AccountLockout is one temporary lockout after repeated failed logins.
+type AccountLockout struct {
+	ID          string     `json:"id" db:"id"`
+	Email       string     `json:"email" db:"email"`
+	UserID      string     `json:"user_id,omitempty" db:"user_id"`
+	IPAddress   string     `json:"ip_address" db:"ip_address"`
+	Failures    int        `json:"failures" db:"failures"`
+	LockedUntil time.Time  `json:"locked_until" db:"locked_until"`
+	Active      bool       `json:"active" db:"-"`
+	UnlockedAt  *time.Time `json:"unlocked_at,omitempty" db:"unlocked_at"`
+	UnlockedBy  string     `json:"unlocked_by,omitempty" db:"unlocked_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
 type NullString struct {
 	String string
 	Valid  bool
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"database/sql"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// AttemptStore counts failed attempts per key (an IP address, an account,
+// ...). Failures older than the window passed in are forgotten, so a counter
+// starts over once its key has been quiet for that long.
+type AttemptStore interface {
+	// Fail records a failure and returns the number of failures in the
+	// window, this one included.
+	Fail(key string, window time.Duration) (int, error)
+	// Failures returns the number of failures in the window and how long
+	// ago the last one was.
+	Failures(key string, window time.Duration) (int, time.Duration, error)
+	Reset(key string) error
+}
+
+// NewAttemptStore picks the store named by LOGIN_ATTEMPT_STORE: "memory" for
+// a single instance or development, "postgres" (the default) when several
+// API instances need to share counters.
+func NewAttemptStore(dbService *DatabaseService) AttemptStore {
+	if os.Getenv("LOGIN_ATTEMPT_STORE") == "memory" {
+		return NewMemoryAttemptStore()
+	}
+	return NewPostgresAttemptStore(dbService)
+}
+
+type attemptEntry struct {
+	failures int
+	last     time.Time
+}
+
+type MemoryAttemptStore struct {
+	mu        sync.Mutex
+	entries   map[string]*attemptEntry
+	lastSweep time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		entries: make(map[string]*attemptEntry),
+	}
+}
+
+// maxAttemptAge bounds how long the memory store keeps an idle key.
+const maxAttemptAge = 24 * time.Hour
+
+func (s *MemoryAttemptStore) Fail(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, entry := range s.entries {
+			if now.Sub(entry.last) > maxAttemptAge {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.entries[key]
+	if !ok || now.Sub(entry.last) > window {
+		entry = &attemptEntry{}
+		s.entries[key] = entry
+	}
+	entry.failures++
+	entry.last = now
+
+	return entry.failures, nil
+}
+
+func (s *MemoryAttemptStore) Failures(key string, window time.Duration) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return 0, 0, nil
+	}
+
+	since := time.Since(entry.last)
+	if since > window {
+		return 0, 0, nil
+	}
+
+	return entry.failures, since, nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+type PostgresAttemptStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAttemptStore(dbService *DatabaseService) *PostgresAttemptStore {
+	return &PostgresAttemptStore{db: dbService.db}
+}
+
+func (s *PostgresAttemptStore) Fail(key string, window time.Duration) (int, error) {
+	// Rows nobody has failed on for a day are of no further use
+	if _, err := s.db.Exec(`DELETE FROM login_attempts WHERE last_failure_at < NOW() - INTERVAL '1 day'`); err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+		        WHEN login_attempts.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+		        ELSE login_attempts.failures + 1
+		    END,
+		    last_failure_at = NOW()
+		RETURNING failures
+	`
+
+	var failures int
+	err := s.db.QueryRow(query, key, window.Seconds()).Scan(&failures)
+	return failures, err
+}
+
+func (s *PostgresAttemptStore) Failures(key string, window time.Duration) (int, time.Duration, error) {
+	// The age is worked out in SQL so it doesn't depend on the time zone the
+	// TIMESTAMP column was written in
+	query := `
+		SELECT failures, EXTRACT(EPOCH FROM NOW() - last_failure_at)
+		FROM login_attempts
+		WHERE key = $1 AND last_failure_at >= NOW() - make_interval(secs => $2)
+	`
+
+	var failures int
+	var seconds float64
+	err := s.db.QueryRow(query, key, window.Seconds()).Scan(&failures, &seconds)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return failures, time.Duration(math.Max(seconds, 0) * float64(time.Second)), nil
+}
+
+func (s *PostgresAttemptStore) Reset(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_attempts WHERE key = $1`, key)
+	return err
+}
@@ -2,97 +2,169 @@ package services
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 	"recipehub/models"
 )
 
+var (
+	ErrSessionRevoked = errors.New("session has been revoked")
+	ErrTokenRevoked   = errors.New("token has been revoked")
+)
+
 type AuthService struct {
-	jwtSecret []byte
+	mu           sync.RWMutex
+	keys         *KeySet
+	claimsFormat string
+	argon2       Argon2Params
+	policy       *PasswordPolicy
+	db           *DatabaseService
+	revocations  RevocationStore
+
+	dummyHashOnce sync.Once
+	dummyHash     string
 }
 
-func NewAuthService() *AuthService {
-	secret := []byte("your-256-bit-secret-key-here-make-it-long-and-random")
+func NewAuthService(dbService *DatabaseService, revocations RevocationStore) *AuthService {
+	keys, err := LoadKeySet()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to load JWT signing keys: %v", err))
+	}
+
+	argon2Params, err := LoadArgon2Params()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to load password hashing parameters: %v", err))
+	}
+
 	return &AuthService{
-		jwtSecret: secret,
+		keys:         keys,
+		claimsFormat: claimsFormat(),
+		argon2:       argon2Params,
+		policy:       NewPasswordPolicy(),
+		db:           dbService,
+		revocations:  revocations,
 	}
 }
 
-type Claims struct {
-	UserID   string `json:"sub"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Role     string `json:"role"`
-	jwt.RegisteredClaims
+// ReloadKeys re-reads the keyset from configuration so a new active key can
+// be rolled out without a restart. The current keyset is kept on error.
+func (s *AuthService) ReloadKeys() error {
+	keys, err := LoadKeySet()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	return nil
 }
 
-func (s *AuthService) HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
+func (s *AuthService) keySet() *KeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
 }
 
-func (s *AuthService) CheckPassword(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+// JWKS returns the public signing keys for verifiers such as Hasura.
+func (s *AuthService) JWKS() JWKSet {
+	return s.keySet().JWKS()
 }
 
-func (s *AuthService) GenerateTokens(user *models.User) (string, string, error) {
-	// Access token (15 minutes)
-	accessClaims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Email:    user.Email,
-		Role:     "user",
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "recipehub",
-			Subject:   user.ID,
-		},
-	}
+type Claims struct {
+	UserID    string        `json:"sub"`
+	Username  string        `json:"username"`
+	Email     string        `json:"email"`
+	SessionID string        `json:"sid"`
+	Hasura    *HasuraClaims `json:"https://hasura.io/jwt/claims,omitempty"`
+	jwt.RegisteredClaims
+}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString(s.jwtSecret)
-	if err != nil {
-		return "", "", err
-	}
+const (
+	AccessTokenTTL        = 15 * time.Minute
+	RefreshTokenTTL       = 7 * 24 * time.Hour
+	PasswordResetTokenTTL = time.Hour
 
-	// Refresh token (7 days)
-	refreshClaims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Email:    user.Email,
-		Role:     "user",
+	EmailVerificationTokenTTL = 24 * time.Hour
+	EmailChangeTokenTTL       = 24 * time.Hour
+	MagicLinkTokenTTL         = 15 * time.Minute
+
+	// Verification emails can be resent once per cooldown and at most
+	// EmailVerificationDailyLimit times in 24 hours.
+	EmailVerificationCooldown   = time.Minute
+	EmailVerificationDailyLimit = 5
+)
+
+// GenerateAccessToken signs a short-lived access token bound to sessionID.
+// roles are the user's stored roles and become the Hasura allowed roles.
+func (s *AuthService) GenerateAccessToken(user *models.User, roles []string, sessionID string) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		SessionID: sessionID,
+		Hasura:    newHasuraClaims(user.ID, roles, s.claimsFormat),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 			Issuer:    "recipehub",
 			Subject:   user.ID,
+			ID:        uuid.New().String(),
 		},
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString(s.jwtSecret)
-	if err != nil {
+	return s.sign(claims)
+}
+
+// GenerateRefreshToken returns an opaque refresh token and the digest that
+// is stored server-side in its place.
+func (s *AuthService) GenerateRefreshToken() (string, string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
 		return "", "", err
 	}
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+	return token, s.HashRefreshToken(token), nil
+}
+
+func (s *AuthService) HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sign signs claims with the active key and records its kid in the header.
+func (s *AuthService) sign(claims jwt.Claims) (string, error) {
+	key := s.keySet().Active()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
 
-	return accessTokenString, refreshTokenString, nil
+	return token.SignedString(key.signKey)
 }
 
 func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
+	keys := s.keySet()
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, err := keys.Lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return s.jwtSecret, nil
+		return key.verifyKey, nil
 	})
 
 	if err != nil {
@@ -106,18 +178,38 @@ func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	return nil, errors.New("invalid token")
 }
 
-func (s *AuthService) GenerateResetToken() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+// Authenticate validates an access token and checks that neither the token
+// nor the session it was issued for has been revoked.
+func (s *AuthService) Authenticate(tokenString string) (*Claims, error) {
+	claims, err := s.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
 	}
-	return base64.URLEncoding.EncodeToString(bytes), nil
-}
 
-func (s *AuthService) GenerateEmailVerificationToken() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+	if claims.SessionID == "" || claims.ID == "" {
+		return nil, errors.New("token is not bound to a session")
+	}
+
+	revoked, err := s.revocations.IsRevoked(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	active, err := s.db.IsSessionActive(claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, ErrSessionRevoked
 	}
-	return base64.URLEncoding.EncodeToString(bytes), nil
+
+	return claims, nil
+}
+
+// RevokeToken adds an access token to the revocation list until it expires.
+func (s *AuthService) RevokeToken(claims *Claims) error {
+	return s.revocations.Revoke(claims.ID, claims.ExpiresAt.Time)
 }
@@ -2,28 +2,38 @@ package services
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
 type ChapaService struct {
-	secretKey string
-	baseURL   string
+	secretKey     string
+	webhookSecret string
+	baseURL       string
 }
 
+// NewChapaService reads CHAPA_SECRET_KEY and CHAPA_WEBHOOK_SECRET.
+// CHAPA_BASE_URL overrides the API base URL, e.g. for a local mock.
 func NewChapaService() *ChapaService {
 	return &ChapaService{
-		secretKey: os.Getenv("CHAPA_SECRET_KEY"),
-		baseURL:   "https://api.chapa.co/v1",
+		secretKey:     os.Getenv("CHAPA_SECRET_KEY"),
+		webhookSecret: os.Getenv("CHAPA_WEBHOOK_SECRET"),
+		baseURL:       baseURLFromEnv("CHAPA_BASE_URL", "https://api.chapa.co/v1"),
 	}
 }
 
 type PaymentRequest struct {
 	Amount      float64 `json:"amount"`
 	Currency    string  `json:"currency"`
-	Email       string  `json:"email"`
+	Email       string  `json:"email,omitempty"`
+	PhoneNumber string  `json:"phone_number,omitempty"`
 	FirstName   string  `json:"first_name"`
 	LastName    string  `json:"last_name"`
 	TxRef       string  `json:"tx_ref"`
@@ -119,3 +129,124 @@ func (s *ChapaService) VerifyPayment(txRef string) (*VerificationResponse, error
 
 	return &verifyResp, nil
 }
+
+// VerifyWebhookSignature checks a webhook delivery against the signatures
+// Chapa sends in the Chapa-Signature and x-chapa-signature headers: a
+// hex-encoded HMAC-SHA256 of the raw body keyed with the webhook secret set
+// in the Chapa dashboard (CHAPA_WEBHOOK_SECRET). One matching signature is
+// enough.
+func (s *ChapaService) VerifyWebhookSignature(body []byte, signatures ...string) (bool, error) {
+	if s.webhookSecret == "" {
+		return false, ErrWebhookNotConfigured
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.webhookSecret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		got, err := hex.DecodeString(strings.TrimSpace(signature))
+		if err != nil || len(got) == 0 {
+			continue
+		}
+		if hmac.Equal(got, expected) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ChapaService is the "chapa" PaymentGateway.
+func (s *ChapaService) Name() string {
+	return "chapa"
+}
+
+func (s *ChapaService) Initialize(req *PaymentRequest) (string, error) {
+	resp, err := s.InitializePayment(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Data.CheckoutURL, nil
+}
+
+func (s *ChapaService) Verify(reference string) (*PaymentResult, error) {
+	resp, err := s.VerifyPayment(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	status := PaymentFailed
+	switch resp.Data.Status {
+	case "success":
+		status = PaymentSucceeded
+	case "pending":
+		status = PaymentPending
+	}
+
+	return &PaymentResult{
+		Reference: reference,
+		Status:    status,
+		Amount:    resp.Data.Amount,
+		Currency:  resp.Data.Currency,
+	}, nil
+}
+
+func (s *ChapaService) Refund(reference string, amount float64, reason string) error {
+	jsonData, err := json.Marshal(map[string]string{
+		"amount": fmt.Sprintf("%.2f", amount),
+		"reason": reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", s.baseURL+"/refund/"+url.PathEscape(reference), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Authorization", "Bearer "+s.secretKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var refundResp struct {
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&refundResp); err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK || refundResp.Status != "success" {
+		return fmt.Errorf("refund failed: %s", refundResp.Message)
+	}
+
+	return nil
+}
+
+func (s *ChapaService) ParseWebhook(header http.Header, body []byte) (*WebhookEvent, error) {
+	valid, err := s.VerifyWebhookSignature(body, header.Get("x-chapa-signature"), header.Get("Chapa-Signature"))
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, ErrInvalidWebhookSignature
+	}
+
+	var payload struct {
+		TxRef  string `json:"tx_ref"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.TxRef == "" {
+		return nil, ErrInvalidWebhookPayload
+	}
+
+	return &WebhookEvent{Reference: payload.TxRef, Status: payload.Status}, nil
+}
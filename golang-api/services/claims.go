@@ -0,0 +1,97 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+)
+
+const (
+	HasuraClaimsNamespace = "https://hasura.io/jwt/claims"
+
+	// DefaultRole is granted to every account; stored roles are added on top.
+	DefaultRole = "user"
+
+	// HasuraSiteAdminRole is what RoleAdmin is called in Hasura claims.
+	// Hasura's own "admin" role skips every permission rule, so it must never
+	// come from a role stored for a user.
+	HasuraSiteAdminRole = "site_admin"
+	hasuraReservedRole  = "admin"
+
+	ClaimsFormatJSON            = "json"
+	ClaimsFormatStringifiedJSON = "stringified_json"
+)
+
+// HasuraClaims is the namespace Hasura reads session variables from. It is
+// emitted either as a nested object or, for claims_format
+// "stringified_json", as a JSON string.
+type HasuraClaims struct {
+	AllowedRoles []string `json:"x-hasura-allowed-roles"`
+	DefaultRole  string   `json:"x-hasura-default-role"`
+	UserID       string   `json:"x-hasura-user-id"`
+
+	stringified bool
+}
+
+type hasuraClaimsFields HasuraClaims
+
+func (h HasuraClaims) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(hasuraClaimsFields(h))
+	if err != nil || !h.stringified {
+		return data, err
+	}
+	return json.Marshal(string(data))
+}
+
+func (h *HasuraClaims) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var inner string
+		if err := json.Unmarshal(data, &inner); err != nil {
+			return err
+		}
+		data = []byte(inner)
+		h.stringified = true
+	}
+	return json.Unmarshal(data, (*hasuraClaimsFields)(h))
+}
+
+// HasRole reports whether role is one of the allowed roles.
+func (h *HasuraClaims) HasRole(role string) bool {
+	for _, allowed := range h.AllowedRoles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+func claimsFormat() string {
+	if os.Getenv("HASURA_CLAIMS_FORMAT") == ClaimsFormatStringifiedJSON {
+		return ClaimsFormatStringifiedJSON
+	}
+	return ClaimsFormatJSON
+}
+
+// HasuraRole is the name of an app role in Hasura claims.
+func HasuraRole(role string) string {
+	if role == RoleAdmin {
+		return HasuraSiteAdminRole
+	}
+	return role
+}
+
+func newHasuraClaims(userID string, roles []string, format string) *HasuraClaims {
+	allowed := []string{DefaultRole}
+	for _, role := range roles {
+		role = HasuraRole(role)
+		if role != hasuraReservedRole && !containsString(allowed, role) {
+			allowed = append(allowed, role)
+		}
+	}
+
+	return &HasuraClaims{
+		AllowedRoles: allowed,
+		DefaultRole:  DefaultRole,
+		UserID:       userID,
+		stringified:  format == ClaimsFormatStringifiedJSON,
+	}
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHasuraClaimsNeverGrantHasuraAdmin(t *testing.T) {
+	for _, format := range []string{ClaimsFormatJSON, ClaimsFormatStringifiedJSON} {
+		claims := newHasuraClaims("user-1", []string{RoleAdmin, RoleModerator, "admin"}, format)
+
+		if claims.DefaultRole == hasuraReservedRole {
+			t.Errorf("%s: default role is %q", format, claims.DefaultRole)
+		}
+		if claims.HasRole(hasuraReservedRole) {
+			t.Errorf("%s: allowed roles %v include %q", format, claims.AllowedRoles, hasuraReservedRole)
+		}
+		if !claims.HasRole(HasuraSiteAdminRole) {
+			t.Errorf("%s: allowed roles %v are missing %q", format, claims.AllowedRoles, HasuraSiteAdminRole)
+		}
+
+		data, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), `"admin"`) || strings.Contains(string(data), `\"admin\"`) {
+			t.Errorf("%s: encoded claims contain the admin role: %s", format, data)
+		}
+	}
+}
+
+func TestClaimsHasRoleMapsAdmin(t *testing.T) {
+	claims := &Claims{Hasura: newHasuraClaims("user-1", []string{RoleAdmin}, ClaimsFormatJSON)}
+
+	if !claims.HasRole(RoleAdmin) {
+		t.Error("admin grant is not recognised")
+	}
+	if claims.HasRole(RoleModerator) {
+		t.Error("moderator reported without a grant")
+	}
+}
@@ -2,16 +2,23 @@ package services
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"recipehub/models"
 )
 
 type DatabaseService struct {
 	db *sql.DB
+
+	authTokensOnce sync.Once
+	authTokensErr  error
 }
 
 func NewDatabaseService() *DatabaseService {
@@ -32,7 +39,16 @@ func NewDatabaseService() *DatabaseService {
 	return &DatabaseService{db: db}
 }
 
+// NormalizeEmail is the form email addresses are stored and looked up in.
+// Addresses are compared case-insensitively, so "Foo@x.com" and "foo@x.com"
+// are the same account.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func (s *DatabaseService) CreateUser(user *models.User) error {
+	user.Email = NormalizeEmail(user.Email)
+
 	query := `
 		INSERT INTO users (email, username, first_name, last_name, password_hash, bio, avatar)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
@@ -56,13 +72,14 @@ func (s *DatabaseService) CreateUser(user *models.User) error {
 func (s *DatabaseService) GetUserByEmail(email string) (*models.User, error) {
 	user := &models.User{}
 	query := `
-		SELECT id, email, username, first_name, last_name, password_hash, bio, avatar, 
-		       is_verified, is_active, email_verified_at, created_at, updated_at
+		SELECT id, COALESCE(email, ''), username, first_name, last_name, password_hash, bio, avatar, 
+		       is_verified, is_active, email_verified_at, COALESCE(phone, ''), phone_verified_at,
+		       created_at, updated_at
 		FROM users 
-		WHERE email = $1
+		WHERE lower(email) = $1
 	`
 
-	err := s.db.QueryRow(query, email).Scan(
+	err := s.db.QueryRow(query, NormalizeEmail(email)).Scan(
 		&user.ID,
 		&user.Email,
 		&user.Username,
@@ -74,6 +91,8 @@ func (s *DatabaseService) GetUserByEmail(email string) (*models.User, error) {
 		&user.IsVerified,
 		&user.IsActive,
 		&user.EmailVerifiedAt,
+		&user.Phone,
+		&user.PhoneVerifiedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -88,8 +107,9 @@ func (s *DatabaseService) GetUserByEmail(email string) (*models.User, error) {
 func (s *DatabaseService) GetUserByUsername(username string) (*models.User, error) {
 	user := &models.User{}
 	query := `
-		SELECT id, email, username, first_name, last_name, password_hash, bio, avatar, 
-		       is_verified, is_active, email_verified_at, created_at, updated_at
+		SELECT id, COALESCE(email, ''), username, first_name, last_name, password_hash, bio, avatar, 
+		       is_verified, is_active, email_verified_at, COALESCE(phone, ''), phone_verified_at,
+		       created_at, updated_at
 		FROM users 
 		WHERE username = $1
 	`
@@ -106,6 +126,8 @@ func (s *DatabaseService) GetUserByUsername(username string) (*models.User, erro
 		&user.IsVerified,
 		&user.IsActive,
 		&user.EmailVerifiedAt,
+		&user.Phone,
+		&user.PhoneVerifiedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -120,8 +142,9 @@ func (s *DatabaseService) GetUserByUsername(username string) (*models.User, erro
 func (s *DatabaseService) GetUserByID(id string) (*models.User, error) {
 	user := &models.User{}
 	query := `
-		SELECT id, email, username, first_name, last_name, password_hash, bio, avatar, 
-		       is_verified, is_active, email_verified_at, created_at, updated_at
+		SELECT id, COALESCE(email, ''), username, first_name, last_name, password_hash, bio, avatar, 
+		       is_verified, is_active, email_verified_at, COALESCE(phone, ''), phone_verified_at,
+		       created_at, updated_at
 		FROM users 
 		WHERE id = $1
 	`
@@ -138,6 +161,8 @@ func (s *DatabaseService) GetUserByID(id string) (*models.User, error) {
 		&user.IsVerified,
 		&user.IsActive,
 		&user.EmailVerifiedAt,
+		&user.Phone,
+		&user.PhoneVerifiedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -149,52 +174,420 @@ func (s *DatabaseService) GetUserByID(id string) (*models.User, error) {
 	return user, nil
 }
 
-func (s *DatabaseService) SavePasswordResetToken(userID, token string) error {
-	// Create password_reset_tokens table if it doesn't exist
-	createTableQuery := `
-		CREATE TABLE IF NOT EXISTS password_reset_tokens (
-			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			token VARCHAR(255) NOT NULL,
-			expires_at TIMESTAMP NOT NULL,
-			created_at TIMESTAMP DEFAULT NOW()
-		)
+func (s *DatabaseService) GetUserByPhone(phone string) (*models.User, error) {
+	user := &models.User{}
+	query := `
+		SELECT id, COALESCE(email, ''), username, first_name, last_name, password_hash, bio, avatar,
+		       is_verified, is_active, email_verified_at, COALESCE(phone, ''), phone_verified_at,
+		       created_at, updated_at
+		FROM users
+		WHERE phone = $1
 	`
-	
-	if _, err := s.db.Exec(createTableQuery); err != nil {
-		return err
+
+	err := s.db.QueryRow(query, phone).Scan(
+		&user.ID,
+		&user.Email,
+		&user.Username,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.Bio,
+		&user.Avatar,
+		&user.IsVerified,
+		&user.IsActive,
+		&user.EmailVerifiedAt,
+		&user.Phone,
+		&user.PhoneVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
 	}
 
-	// Delete any existing tokens for this user
-	deleteQuery := `DELETE FROM password_reset_tokens WHERE user_id = $1`
-	if _, err := s.db.Exec(deleteQuery, userID); err != nil {
-		return err
+	return user, nil
+}
+
+// CreateUserWithPhone creates an account for a verified phone number, with
+// no email or password.
+func (s *DatabaseService) CreateUserWithPhone(user *models.User) error {
+	query := `
+		INSERT INTO users (email, phone, phone_verified_at, username, first_name, last_name, password_hash, bio, avatar)
+		VALUES (NULL, $1, NOW(), $2, $3, $4, '', $5, $6)
+		RETURNING id, is_active, phone_verified_at, created_at, updated_at
+	`
+
+	return s.db.QueryRow(
+		query,
+		user.Phone,
+		user.Username,
+		user.FirstName,
+		user.LastName,
+		user.Bio,
+		user.Avatar,
+	).Scan(&user.ID, &user.IsActive, &user.PhoneVerifiedAt, &user.CreatedAt, &user.UpdatedAt)
+}
+
+// SetUserPhone attaches a verified phone number to the user, replacing any
+// previous one. It reports false if the number belongs to another account.
+func (s *DatabaseService) SetUserPhone(userID, phone string) (bool, error) {
+	query := `
+		UPDATE users
+		SET phone = $1, phone_verified_at = NOW(), updated_at = NOW()
+		WHERE id = $2 AND NOT EXISTS (SELECT 1 FROM users WHERE phone = $1 AND id <> $2)
+	`
+	result, err := s.db.Exec(query, phone, userID)
+	if err != nil {
+		return false, err
 	}
 
-	// Insert new token (expires in 1 hour)
-	insertQuery := `
-		INSERT INTO password_reset_tokens (user_id, token, expires_at)
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+func (s *DatabaseService) GetUserRoles(userID string) ([]string, error) {
+	query := `SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// GetUserRoleAssignments returns the user's stored roles with when they were
+// granted. DefaultRole is implicit and not included.
+func (s *DatabaseService) GetUserRoleAssignments(userID string) ([]*models.UserRole, error) {
+	query := `SELECT user_id, role, created_at FROM user_roles WHERE user_id = $1 ORDER BY role`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*models.UserRole{}
+	for rows.Next() {
+		role := &models.UserRole{}
+		if err := rows.Scan(&role.UserID, &role.Role, &role.CreatedAt); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// GrantRole gives the user a role and records it in the audit log. It
+// reports false, without an audit entry, if the user already had it.
+func (s *DatabaseService) GrantRole(userID, role string, actor *models.RoleActor, reason string) (bool, error) {
+	return s.changeRole(
+		`INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		"grant", userID, role, actor, reason,
+	)
+}
+
+// RevokeRole takes a role away from the user and records it in the audit
+// log. It reports false, without an audit entry, if the user didn't have it.
+func (s *DatabaseService) RevokeRole(userID, role string, actor *models.RoleActor, reason string) (bool, error) {
+	return s.changeRole(
+		`DELETE FROM user_roles WHERE user_id = $1 AND role = $2`,
+		"revoke", userID, role, actor, reason,
+	)
+}
+
+func (s *DatabaseService) changeRole(change, action, userID, role string, actor *models.RoleActor, reason string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(change, userID, role)
+	if err != nil {
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO role_audit_log (user_id, role, action, actor_id, actor, reason)
+		VALUES ($1, $2, $3, NULLIF($4, '')::uuid, $5, $6)
+	`, userID, role, action, actor.UserID, actor.Name, reason)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetRoleAuditLog returns the most recent role changes, newest first; with a
+// non-empty userID only that user's.
+func (s *DatabaseService) GetRoleAuditLog(userID string, limit int) ([]*models.RoleAuditEntry, error) {
+	query := `
+		SELECT id, COALESCE(user_id::text, ''), role, action, COALESCE(actor_id::text, ''),
+		       actor, COALESCE(reason, ''), created_at
+		FROM role_audit_log
+		WHERE $1 = '' OR user_id::text = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+
+	rows, err := s.db.Query(query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*models.RoleAuditEntry{}
+	for rows.Next() {
+		entry := &models.RoleAuditEntry{}
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.UserID,
+			&entry.Role,
+			&entry.Action,
+			&entry.ActorID,
+			&entry.Actor,
+			&entry.Reason,
+			&entry.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// CreateRefreshToken stores a refresh token that expires ttl from now. The
+// expiry is computed by the database, like every NOW() it is compared with.
+func (s *DatabaseService) CreateRefreshToken(token *models.RefreshToken, ttl time.Duration) error {
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		RETURNING id, expires_at, created_at
+	`
+
+	err := s.db.QueryRow(
+		query,
+		token.UserID,
+		token.FamilyID,
+		token.TokenHash,
+		ttl.Seconds(),
+	).Scan(&token.ID, &token.ExpiresAt, &token.CreatedAt)
+
+	return err
+}
+
+// RotateRefreshToken marks a live refresh token as used and returns it. It
+// returns sql.ErrNoRows when the token is unknown, expired, revoked or was
+// already rotated, so concurrent requests can't both redeem the same token.
+func (s *DatabaseService) RotateRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+	token := &models.RefreshToken{}
+	query := `
+		UPDATE refresh_tokens SET rotated_at = NOW()
+		WHERE token_hash = $1 AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING id, user_id, family_id, token_hash, expires_at, rotated_at, revoked_at, created_at
+	`
+
+	err := s.db.QueryRow(query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.RotatedAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (s *DatabaseService) GetRefreshTokenByHash(tokenHash string) (*models.RefreshToken, error) {
+	token := &models.RefreshToken{}
+	query := `
+		SELECT id, user_id, family_id, token_hash, expires_at, rotated_at, revoked_at, created_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`
+
+	err := s.db.QueryRow(query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.RotatedAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (s *DatabaseService) CreateSession(session *models.Session) error {
+	query := `
+		INSERT INTO user_sessions (user_id, user_agent, ip_address)
 		VALUES ($1, $2, $3)
+		RETURNING id, created_at, last_seen_at
 	`
-	
-	expiresAt := time.Now().Add(time.Hour)
-	_, err := s.db.Exec(insertQuery, userID, token, expiresAt)
+
+	err := s.db.QueryRow(
+		query,
+		session.UserID,
+		session.UserAgent,
+		session.IPAddress,
+	).Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
+
 	return err
 }
 
-func (s *DatabaseService) VerifyPasswordResetToken(token string) (string, error) {
-	var userID string
+func (s *DatabaseService) TouchSession(sessionID, ipAddress, userAgent string) error {
 	query := `
-		SELECT user_id FROM password_reset_tokens 
-		WHERE token = $1 AND expires_at > NOW()
+		UPDATE user_sessions SET ip_address = $1, user_agent = $2, last_seen_at = NOW()
+		WHERE id = $3
 	`
+	_, err := s.db.Exec(query, ipAddress, userAgent, sessionID)
+	return err
+}
+
+// SessionAge is how long ago the user signed in to start the session;
+// refreshing its tokens doesn't reset it. It returns sql.ErrNoRows for an
+// unknown or revoked session.
+func (s *DatabaseService) SessionAge(userID, sessionID string) (time.Duration, error) {
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return 0, sql.ErrNoRows
+	}
+
+	var seconds float64
+	query := `
+		SELECT EXTRACT(EPOCH FROM NOW() - created_at) FROM user_sessions
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+	err := s.db.QueryRow(query, sessionID, userID).Scan(&seconds)
+	return time.Duration(seconds * float64(time.Second)), err
+}
+
+func (s *DatabaseService) IsSessionActive(sessionID string) (bool, error) {
+	var active bool
+	query := `SELECT EXISTS (SELECT 1 FROM user_sessions WHERE id = $1 AND revoked_at IS NULL)`
+	err := s.db.QueryRow(query, sessionID).Scan(&active)
+	return active, err
+}
 
-	err := s.db.QueryRow(query, token).Scan(&userID)
+func (s *DatabaseService) GetActiveSessions(userID string) ([]*models.Session, error) {
+	query := `
+		SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(HOST(ip_address), ''),
+		       created_at, last_seen_at, revoked_at
+		FROM user_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY last_seen_at DESC
+	`
+
+	rows, err := s.db.Query(query, userID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return userID, nil
+	sessions := []*models.Session{}
+	for rows.Next() {
+		session := &models.Session{}
+		if err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IPAddress,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.RevokedAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends a session and every refresh token issued for it.
+func (s *DatabaseService) RevokeSession(sessionID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE user_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, sessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeUserSession revokes sessionID only if it belongs to userID and
+// reports whether it did.
+func (s *DatabaseService) RevokeUserSession(userID, sessionID string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM user_sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)`
+	if err := s.db.QueryRow(query, sessionID, userID).Scan(&exists); err != nil || !exists {
+		return false, err
+	}
+
+	return true, s.RevokeSession(sessionID)
+}
+
+// RevokeOtherSessions ends every active session of userID except keepID.
+func (s *DatabaseService) RevokeOtherSessions(userID, keepID string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE user_sessions SET revoked_at = NOW()
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+	`, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL
+	`, userID, keepID); err != nil {
+		return 0, err
+	}
+
+	revoked, _ := result.RowsAffected()
+	return revoked, tx.Commit()
 }
 
 func (s *DatabaseService) UpdateUserPassword(userID, hashedPassword string) error {
@@ -203,40 +596,175 @@ func (s *DatabaseService) UpdateUserPassword(userID, hashedPassword string) erro
 	return err
 }
 
-func (s *DatabaseService) DeletePasswordResetToken(token string) error {
-	query := `DELETE FROM password_reset_tokens WHERE token = $1`
-	_, err := s.db.Exec(query, token)
+func (s *DatabaseService) ensureAuthTokensTable() error {
+	s.authTokensOnce.Do(func() {
+		createTableQuery := `
+			CREATE TABLE IF NOT EXISTS auth_tokens (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				purpose VARCHAR(32) NOT NULL,
+				selector VARCHAR(32) UNIQUE NOT NULL,
+				token_hash VARCHAR(64) NOT NULL,
+				payload TEXT,
+				expires_at TIMESTAMP NOT NULL,
+				consumed_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT NOW()
+			)
+		`
+		if _, s.authTokensErr = s.db.Exec(createTableQuery); s.authTokensErr != nil {
+			return
+		}
+
+		// Tables created before tokens could carry data or be marked consumed
+		// lack the columns. The old plaintext token tables are dropped by
+		// database/migrations/001_drop_plaintext_token_tables.sql, never here
+		_, s.authTokensErr = s.db.Exec(`
+			ALTER TABLE auth_tokens
+				ADD COLUMN IF NOT EXISTS payload TEXT,
+				ADD COLUMN IF NOT EXISTS consumed_at TIMESTAMP
+		`)
+	})
+
+	return s.authTokensErr
+}
+
+// SaveAuthToken stores a new token digest that expires ttl from now, by the
+// database clock. Live tokens of the same user and purpose are expired rather
+// than deleted so they still count towards the resend limits.
+func (s *DatabaseService) SaveAuthToken(token *models.AuthToken, ttl time.Duration) error {
+	if err := s.ensureAuthTokensTable(); err != nil {
+		return err
+	}
+
+	expireQuery := `
+		UPDATE auth_tokens SET expires_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND expires_at > NOW()
+	`
+	if _, err := s.db.Exec(expireQuery, token.UserID, token.Purpose); err != nil {
+		return err
+	}
+
+	insertQuery := `
+		INSERT INTO auth_tokens (user_id, purpose, selector, token_hash, payload, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NOW() + make_interval(secs => $6))
+		RETURNING id, expires_at, created_at
+	`
+
+	err := s.db.QueryRow(
+		insertQuery,
+		token.UserID,
+		token.Purpose,
+		token.Selector,
+		token.TokenHash,
+		token.Payload,
+		ttl.Seconds(),
+	).Scan(&token.ID, &token.ExpiresAt, &token.CreatedAt)
+
 	return err
 }
 
-func (s *DatabaseService) VerifyEmailToken(token string) (string, error) {
-	// Create email_verification_tokens table if it doesn't exist
-	createTableQuery := `
-		CREATE TABLE IF NOT EXISTS email_verification_tokens (
-			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			token VARCHAR(255) NOT NULL,
-			expires_at TIMESTAMP NOT NULL,
-			created_at TIMESTAMP DEFAULT NOW()
-		)
+// GetAuthToken returns the live token with the given purpose and selector.
+func (s *DatabaseService) GetAuthToken(purpose TokenPurpose, selector string) (*models.AuthToken, error) {
+	if err := s.ensureAuthTokensTable(); err != nil {
+		return nil, err
+	}
+
+	token := &models.AuthToken{}
+	query := `
+		SELECT id, user_id, purpose, selector, token_hash, COALESCE(payload, ''), expires_at, created_at
+		FROM auth_tokens
+		WHERE purpose = $1 AND selector = $2 AND consumed_at IS NULL AND expires_at > NOW()
 	`
-	
-	if _, err := s.db.Exec(createTableQuery); err != nil {
-		return "", err
+
+	err := s.db.QueryRow(query, string(purpose), selector).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Purpose,
+		&token.Selector,
+		&token.TokenHash,
+		&token.Payload,
+		&token.ExpiresAt,
+		&token.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
 	}
 
-	var userID string
+	return token, nil
+}
+
+// ConsumeAuthToken marks a redeemed token consumed and reports whether it
+// was still live. The row is kept so it still counts towards the resend
+// limits.
+func (s *DatabaseService) ConsumeAuthToken(id string) (bool, error) {
 	query := `
-		SELECT user_id FROM email_verification_tokens 
-		WHERE token = $1 AND expires_at > NOW()
+		UPDATE auth_tokens SET consumed_at = NOW()
+		WHERE id = $1 AND consumed_at IS NULL AND expires_at > NOW()
 	`
+	result, err := s.db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
 
-	err := s.db.QueryRow(query, token).Scan(&userID)
+	consumed, err := result.RowsAffected()
+	return consumed == 1, err
+}
+
+// ExpireUserAuthTokens voids the user's live tokens of purpose. Like
+// SaveAuthToken it expires them rather than deleting them, so they still
+// count towards the resend limits.
+func (s *DatabaseService) ExpireUserAuthTokens(userID string, purpose TokenPurpose) error {
+	if err := s.ensureAuthTokensTable(); err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE auth_tokens SET expires_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND expires_at > NOW()
+	`
+	_, err := s.db.Exec(query, userID, string(purpose))
+	return err
+}
+
+// GetAuthTokenActivity returns how many tokens of purpose were issued to the
+// user in the last 24 hours and how long ago the oldest and the latest of
+// them were issued. Ages are computed by the database so they don't depend
+// on the server's time zone.
+func (s *DatabaseService) GetAuthTokenActivity(userID string, purpose TokenPurpose) (int, time.Duration, time.Duration, error) {
+	if err := s.ensureAuthTokensTable(); err != nil {
+		return 0, 0, 0, err
+	}
+
+	var count int
+	var oldest, latest float64
+	query := `
+		SELECT COUNT(*),
+		       COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at)), 0),
+		       COALESCE(EXTRACT(EPOCH FROM NOW() - MAX(created_at)), 0)
+		FROM auth_tokens
+		WHERE user_id = $1 AND purpose = $2 AND created_at > NOW() - INTERVAL '24 hours'
+	`
+
+	err := s.db.QueryRow(query, userID, string(purpose)).Scan(&count, &oldest, &latest)
+	return count, time.Duration(oldest * float64(time.Second)), time.Duration(latest * float64(time.Second)), err
+}
+
+// UpdateUserEmail switches the user to a confirmed new address. It reports
+// false if another account has taken the address in the meantime.
+func (s *DatabaseService) UpdateUserEmail(userID, email string) (bool, error) {
+	query := `
+		UPDATE users
+		SET email = $1, is_verified = true, email_verified_at = NOW(), updated_at = NOW()
+		WHERE id = $2 AND NOT EXISTS (SELECT 1 FROM users WHERE lower(email) = $1 AND id <> $2)
+	`
+	result, err := s.db.Exec(query, NormalizeEmail(email), userID)
 	if err != nil {
-		return "", err
+		return false, err
 	}
 
-	return userID, nil
+	updated, err := result.RowsAffected()
+	return updated == 1, err
 }
 
 func (s *DatabaseService) MarkEmailAsVerified(userID string) error {
@@ -245,10 +773,517 @@ func (s *DatabaseService) MarkEmailAsVerified(userID string) error {
 	return err
 }
 
+func (s *DatabaseService) CreateUserIdentity(identity *models.UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email, last_used_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, created_at, last_used_at
+	`
+
+	return s.db.QueryRow(
+		query,
+		identity.UserID,
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+	).Scan(&identity.ID, &identity.CreatedAt, &identity.LastUsedAt)
+}
+
+// CreateUserWithIdentity creates a password-less account for a first-time
+// social login together with its identity. The provider has verified the
+// email address, so the account starts out verified.
+func (s *DatabaseService) CreateUserWithIdentity(user *models.User, identity *models.UserIdentity) error {
+	user.Email = NormalizeEmail(user.Email)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO users (email, username, first_name, last_name, password_hash, bio, avatar, is_verified, email_verified_at)
+		VALUES ($1, $2, $3, $4, '', $5, $6, true, NOW())
+		RETURNING id, is_active, created_at, updated_at
+	`,
+		user.Email,
+		user.Username,
+		user.FirstName,
+		user.LastName,
+		user.Bio,
+		user.Avatar,
+	).Scan(&user.ID, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	user.IsVerified = true
+
+	identity.UserID = user.ID
+	err = tx.QueryRow(`
+		INSERT INTO user_identities (user_id, provider, subject, email, last_used_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, created_at, last_used_at
+	`,
+		identity.UserID,
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+	).Scan(&identity.ID, &identity.CreatedAt, &identity.LastUsedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *DatabaseService) GetUserIdentity(provider, subject string) (*models.UserIdentity, error) {
+	identity := &models.UserIdentity{}
+	query := `
+		SELECT id, user_id, provider, subject, COALESCE(email, ''), created_at, last_used_at
+		FROM user_identities
+		WHERE provider = $1 AND subject = $2
+	`
+
+	err := s.db.QueryRow(query, provider, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Provider,
+		&identity.Subject,
+		&identity.Email,
+		&identity.CreatedAt,
+		&identity.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+func (s *DatabaseService) GetUserIdentities(userID string) ([]*models.UserIdentity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, COALESCE(email, ''), created_at, last_used_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*models.UserIdentity{}
+	for rows.Next() {
+		identity := &models.UserIdentity{}
+		if err := rows.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Provider,
+			&identity.Subject,
+			&identity.Email,
+			&identity.CreatedAt,
+			&identity.LastUsedAt,
+		); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+func (s *DatabaseService) TouchUserIdentity(id string) error {
+	_, err := s.db.Exec(`UPDATE user_identities SET last_used_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// DeleteUserIdentity unlinks a provider unless it is the user's last way to
+// sign in, i.e. they have no password, no verified phone and no other linked
+// provider. The user row is locked first, so two concurrent unlinks of
+// different providers run one after the other and the second sees the first's
+// result.
+func (s *DatabaseService) DeleteUserIdentity(userID, provider string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var hasOtherLogin bool
+	err = tx.QueryRow(
+		`SELECT password_hash <> '' OR phone_verified_at IS NOT NULL FROM users WHERE id = $1 FOR UPDATE`,
+		userID,
+	).Scan(&hasOtherLogin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+		DELETE FROM user_identities
+		WHERE user_id = $1 AND provider = $2
+		  AND ($3 OR (SELECT COUNT(*) FROM user_identities WHERE user_id = $1) > 1)
+	`
+
+	result, err := tx.Exec(query, userID, provider, hasOtherLogin)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows != 1 {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// SetInitialPassword sets a password for an account that has none, e.g. one
+// created by social login. It reports false if a password is already set.
+func (s *DatabaseService) SetInitialPassword(userID, hashedPassword string) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2 AND password_hash = ''`,
+		hashedPassword, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+func (s *DatabaseService) GetUserTOTP(userID string) (*models.UserTOTP, error) {
+	totp := &models.UserTOTP{}
+	query := `
+		SELECT user_id, secret, enabled_at, last_used_step, created_at
+		FROM user_totp
+		WHERE user_id = $1
+	`
+
+	err := s.db.QueryRow(query, userID).Scan(
+		&totp.UserID,
+		&totp.Secret,
+		&totp.EnabledAt,
+		&totp.LastUsedStep,
+		&totp.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return totp, nil
+}
+
+// IsTOTPEnabled reports whether the user has confirmed a TOTP enrollment.
+func (s *DatabaseService) IsTOTPEnabled(userID string) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)`,
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// SavePendingTOTP stores a new, not yet confirmed secret for the user. It
+// reports false if 2FA is already enabled, since that secret must not change
+// without disabling 2FA first.
+func (s *DatabaseService) SavePendingTOTP(userID, secret string) (bool, error) {
+	query := `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+		WHERE user_totp.enabled_at IS NULL
+	`
+
+	result, err := s.db.Exec(query, userID, secret)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// EnableTOTP confirms a pending enrollment, records the step of the code used
+// to confirm it and replaces the user's recovery codes.
+func (s *DatabaseService) EnableTOTP(userID string, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE user_totp SET enabled_at = NOW(), last_used_step = $2 WHERE user_id = $1 AND enabled_at IS NULL`,
+		userID, step,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows != 1 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec(`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP removes the user's TOTP secret and recovery codes.
+func (s *DatabaseService) DisableTOTP(userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code for step has been used. It reports false
+// if that step (or a later one) was already used, i.e. the code is replayed.
+func (s *DatabaseService) UseTOTPStep(userID string, step int64) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2`,
+		userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// UseRecoveryCode marks an unused recovery code as used and reports whether
+// there was one to use.
+func (s *DatabaseService) UseRecoveryCode(userID, codeHash string) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+func (s *DatabaseService) CountUnusedRecoveryCodes(userID string) (int, error) {
+	var count int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL`,
+		userID,
+	).Scan(&count)
+	return count, err
+}
+
+// CreateAccountLockout records that email was locked after repeated failed
+// logins. userID is empty when no account has that email.
+func (s *DatabaseService) CreateAccountLockout(email, userID, ipAddress string, failures int, duration time.Duration) error {
+	query := `
+		INSERT INTO account_lockouts (email, user_id, ip_address, failures, locked_until)
+		VALUES ($1, NULLIF($2, '')::uuid, NULLIF($3, '')::inet, $4, NOW() + make_interval(secs => $5))
+	`
+
+	_, err := s.db.Exec(query, email, userID, ipAddress, failures, duration.Seconds())
+	return err
+}
+
+// GetAccountLockout returns how much longer email is locked, or zero.
+func (s *DatabaseService) GetAccountLockout(email string) (time.Duration, error) {
+	query := `
+		SELECT COALESCE(MAX(EXTRACT(EPOCH FROM locked_until - NOW())), 0)
+		FROM account_lockouts
+		WHERE email = $1 AND unlocked_at IS NULL AND locked_until > NOW()
+	`
+
+	var seconds float64
+	if err := s.db.QueryRow(query, email).Scan(&seconds); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// UnlockAccount lifts every active lockout for email and reports whether
+// there was one.
+func (s *DatabaseService) UnlockAccount(email, unlockedBy string) (bool, error) {
+	query := `
+		UPDATE account_lockouts
+		SET unlocked_at = NOW(), unlocked_by = $2
+		WHERE email = $1 AND unlocked_at IS NULL AND locked_until > NOW()
+	`
+
+	result, err := s.db.Exec(query, email, unlockedBy)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// GetAccountLockouts returns the most recent lockouts, newest first; with a
+// non-empty email only that account's.
+func (s *DatabaseService) GetAccountLockouts(email string, limit int) ([]*models.AccountLockout, error) {
+	query := `
+		SELECT id, email, COALESCE(user_id::text, ''), COALESCE(HOST(ip_address), ''), failures,
+		       locked_until, locked_until > NOW() AND unlocked_at IS NULL,
+		       unlocked_at, COALESCE(unlocked_by, ''), created_at
+		FROM account_lockouts
+		WHERE $1 = '' OR email = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+
+	rows, err := s.db.Query(query, email, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []*models.AccountLockout{}
+	for rows.Next() {
+		lockout := &models.AccountLockout{}
+		if err := rows.Scan(
+			&lockout.ID,
+			&lockout.Email,
+			&lockout.UserID,
+			&lockout.IPAddress,
+			&lockout.Failures,
+			&lockout.LockedUntil,
+			&lockout.Active,
+			&lockout.UnlockedAt,
+			&lockout.UnlockedBy,
+			&lockout.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	return lockouts, rows.Err()
+}
+
+// SavePhoneOTP stores the digest of a new login code for phone, replacing
+// any earlier one along with its attempt count.
+func (s *DatabaseService) SavePhoneOTP(phone, codeHash string, ttl time.Duration) error {
+	query := `
+		INSERT INTO phone_otps (phone, code_hash, attempts, expires_at, created_at)
+		VALUES ($1, $2, 0, NOW() + make_interval(secs => $3), NOW())
+		ON CONFLICT (phone) DO UPDATE
+		SET code_hash = EXCLUDED.code_hash,
+		    attempts = 0,
+		    expires_at = EXCLUDED.expires_at,
+		    created_at = EXCLUDED.created_at
+	`
+	_, err := s.db.Exec(query, phone, codeHash, ttl.Seconds())
+	return err
+}
+
+// UsePhoneOTPAttempt counts a verification attempt against the live code for
+// phone and returns its digest. It returns sql.ErrNoRows if there is no live
+// code or it has used up maxAttempts.
+func (s *DatabaseService) UsePhoneOTPAttempt(phone string, maxAttempts int) (string, error) {
+	query := `
+		UPDATE phone_otps SET attempts = attempts + 1
+		WHERE phone = $1 AND expires_at > NOW() AND attempts < $2
+		RETURNING code_hash
+	`
+
+	var codeHash string
+	err := s.db.QueryRow(query, phone, maxAttempts).Scan(&codeHash)
+	return codeHash, err
+}
+
+// DeletePhoneOTP removes a redeemed code and reports whether it still
+// existed, so a code can only be redeemed once.
+func (s *DatabaseService) DeletePhoneOTP(phone, codeHash string) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM phone_otps WHERE phone = $1 AND code_hash = $2`, phone, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return deleted == 1, err
+}
+
+func (s *DatabaseService) GetRecipeByID(id string) (*models.Recipe, error) {
+	recipe := &models.Recipe{}
+	query := `
+		SELECT id, title, slug, description, featured_image, prep_time, COALESCE(cook_time, 0),
+		       COALESCE(total_time, 0), servings, COALESCE(difficulty, ''), COALESCE(cuisine_type, ''),
+		       COALESCE(price, 0), COALESCE(is_premium, false), COALESCE(status, ''),
+		       author_id, category_id, created_at, updated_at
+		FROM recipes
+		WHERE id = $1
+	`
+
+	err := s.db.QueryRow(query, id).Scan(
+		&recipe.ID,
+		&recipe.Title,
+		&recipe.Slug,
+		&recipe.Description,
+		&recipe.FeaturedImage,
+		&recipe.PrepTime,
+		&recipe.CookTime,
+		&recipe.TotalTime,
+		&recipe.Servings,
+		&recipe.Difficulty,
+		&recipe.CuisineType,
+		&recipe.Price,
+		&recipe.IsPremium,
+		&recipe.Status,
+		&recipe.AuthorID,
+		&recipe.CategoryID,
+		&recipe.CreatedAt,
+		&recipe.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return recipe, nil
+}
+
+var (
+	// ErrIdempotencyKeyInUse means the user already started a purchase with
+	// the same Idempotency-Key.
+	ErrIdempotencyKeyInUse = errors.New("idempotency key already used")
+	// ErrAlreadyPurchased means the user already has a completed purchase of
+	// the recipe.
+	ErrAlreadyPurchased = errors.New("recipe already purchased")
+)
+
 func (s *DatabaseService) CreateRecipePurchase(purchase *models.RecipePurchase) error {
 	query := `
-		INSERT INTO recipe_purchases (recipe_id, user_id, amount, payment_method, payment_reference, status)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO recipe_purchases (recipe_id, user_id, amount, payment_method, payment_reference, status, checkout_url, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))
 		RETURNING id, created_at, updated_at
 	`
 
@@ -260,26 +1295,60 @@ func (s *DatabaseService) CreateRecipePurchase(purchase *models.RecipePurchase)
 		purchase.PaymentMethod,
 		purchase.PaymentReference,
 		purchase.Status,
+		purchase.CheckoutURL,
+		purchase.IdempotencyKey,
 	).Scan(&purchase.ID, &purchase.CreatedAt, &purchase.UpdatedAt)
 
+	if isUniqueViolation(err) {
+		return ErrIdempotencyKeyInUse
+	}
+	return err
+}
+
+// UpdateRecipePurchaseStatus moves a purchase to status and reports whether
+// this call changed it. Completed and refunded purchases are never changed
+// again, so of two concurrent updates only one sees the transition. It
+// returns ErrAlreadyPurchased when completing a purchase of a recipe the user
+// already owns.
+func (s *DatabaseService) UpdateRecipePurchaseStatus(purchaseID, status string) (bool, error) {
+	query := `
+		UPDATE recipe_purchases SET status = $1, updated_at = NOW()
+		WHERE id = $2 AND status NOT IN ('completed', 'refunded') AND status <> $1
+	`
+	result, err := s.db.Exec(query, status, purchaseID)
+	if isUniqueViolation(err) {
+		return false, ErrAlreadyPurchased
+	}
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *DatabaseService) SetRecipePurchaseCheckout(purchaseID, checkoutURL string) error {
+	query := `UPDATE recipe_purchases SET checkout_url = $1, updated_at = NOW() WHERE id = $2`
+	_, err := s.db.Exec(query, checkoutURL, purchaseID)
 	return err
 }
 
-func (s *DatabaseService) UpdateRecipePurchaseStatus(purchaseID, status string) error {
-	query := `UPDATE recipe_purchases SET status = $1, updated_at = NOW() WHERE id = $2`
-	_, err := s.db.Exec(query, status, purchaseID)
+// DeleteRecipePurchase removes a purchase that never reached the payment
+// provider, freeing its idempotency key for a retry.
+func (s *DatabaseService) DeleteRecipePurchase(purchaseID string) error {
+	_, err := s.db.Exec(`DELETE FROM recipe_purchases WHERE id = $1 AND status = 'pending'`, purchaseID)
 	return err
 }
 
-func (s *DatabaseService) GetRecipePurchaseByReference(reference string) (*models.RecipePurchase, error) {
+const recipePurchaseColumns = `
+	id, recipe_id, user_id, amount, payment_method, payment_reference, status,
+	COALESCE(checkout_url, ''), COALESCE(idempotency_key, ''), created_at, updated_at
+`
+
+func (s *DatabaseService) queryRecipePurchase(query string, args ...interface{}) (*models.RecipePurchase, error) {
 	purchase := &models.RecipePurchase{}
-	query := `
-		SELECT id, recipe_id, user_id, amount, payment_method, payment_reference, status, created_at, updated_at
-		FROM recipe_purchases 
-		WHERE payment_reference = $1
-	`
 
-	err := s.db.QueryRow(query, reference).Scan(
+	err := s.db.QueryRow(query, args...).Scan(
 		&purchase.ID,
 		&purchase.RecipeID,
 		&purchase.UserID,
@@ -287,6 +1356,8 @@ func (s *DatabaseService) GetRecipePurchaseByReference(reference string) (*model
 		&purchase.PaymentMethod,
 		&purchase.PaymentReference,
 		&purchase.Status,
+		&purchase.CheckoutURL,
+		&purchase.IdempotencyKey,
 		&purchase.CreatedAt,
 		&purchase.UpdatedAt,
 	)
@@ -298,6 +1369,69 @@ func (s *DatabaseService) GetRecipePurchaseByReference(reference string) (*model
 	return purchase, nil
 }
 
+func (s *DatabaseService) GetRecipePurchaseByReference(reference string) (*models.RecipePurchase, error) {
+	return s.queryRecipePurchase(`SELECT `+recipePurchaseColumns+` FROM recipe_purchases WHERE payment_reference = $1`, reference)
+}
+
+func (s *DatabaseService) GetRecipePurchaseByIdempotencyKey(userID, key string) (*models.RecipePurchase, error) {
+	return s.queryRecipePurchase(`SELECT `+recipePurchaseColumns+` FROM recipe_purchases WHERE user_id = $1 AND idempotency_key = $2`, userID, key)
+}
+
+// GetCompletedRecipePurchase returns the user's completed purchase of the
+// recipe, if they own it.
+func (s *DatabaseService) GetCompletedRecipePurchase(userID, recipeID string) (*models.RecipePurchase, error) {
+	return s.queryRecipePurchase(`
+		SELECT `+recipePurchaseColumns+`
+		FROM recipe_purchases
+		WHERE user_id = $1 AND recipe_id = $2 AND status = 'completed'
+	`, userID, recipeID)
+}
+
+// GetPendingRecipePurchase returns the user's latest pending purchase of
+// the recipe that has a checkout URL and was started within maxAge.
+func (s *DatabaseService) GetPendingRecipePurchase(userID, recipeID string, maxAge time.Duration) (*models.RecipePurchase, error) {
+	return s.queryRecipePurchase(`
+		SELECT `+recipePurchaseColumns+`
+		FROM recipe_purchases
+		WHERE user_id = $1 AND recipe_id = $2 AND status = 'pending'
+		  AND checkout_url IS NOT NULL AND created_at > NOW() - make_interval(secs => $3)
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID, recipeID, maxAge.Seconds())
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// ClaimWebhookDelivery records a verified webhook delivery by the digest of
+// its body and reports false if the same delivery was already claimed, i.e.
+// it is a replay.
+func (s *DatabaseService) ClaimWebhookDelivery(provider, bodyHash, reference string) (bool, error) {
+	query := `
+		INSERT INTO payment_webhook_deliveries (provider, body_hash, reference)
+		VALUES ($1, $2, NULLIF($3, ''))
+		ON CONFLICT (provider, body_hash) DO NOTHING
+	`
+	result, err := s.db.Exec(query, provider, bodyHash, reference)
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// ReleaseWebhookDelivery forgets a claimed delivery whose processing failed,
+// so the provider's retry of it is accepted.
+func (s *DatabaseService) ReleaseWebhookDelivery(provider, bodyHash string) error {
+	_, err := s.db.Exec(`DELETE FROM payment_webhook_deliveries WHERE provider = $1 AND body_hash = $2`, provider, bodyHash)
+	return err
+}
+
 func (s *DatabaseService) TrackRecipeView(recipeID, userID, ipAddress, userAgent string) error {
 	query := `
 		INSERT INTO recipe_views (recipe_id, user_id, ip_address, user_agent)
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"recipehub/models"
+)
+
+//go:embed templates/email/*
+var emailTemplates embed.FS
+
+// EmailService renders the transactional emails from templates/email and
+// hands them to the configured Mailer.
+type EmailService struct {
+	mailer  Mailer
+	baseURL string
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+func NewEmailService(mailer Mailer) *EmailService {
+	baseURL := os.Getenv("APP_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:3000"
+	}
+
+	return &EmailService{
+		mailer:  mailer,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		html:    htmltemplate.Must(htmltemplate.ParseFS(emailTemplates, "templates/email/*.html")),
+		text:    texttemplate.Must(texttemplate.ParseFS(emailTemplates, "templates/email/*.txt")),
+	}
+}
+
+func (s *EmailService) SendVerificationEmail(user *models.User, token string, expiresIn time.Duration) error {
+	return s.send(user.Email, "Verify your RecipeHub email", "verification", map[string]interface{}{
+		"Name":      displayName(user),
+		"Link":      s.link("/verify-email", token),
+		"ExpiresIn": humanDuration(expiresIn),
+	})
+}
+
+func (s *EmailService) SendPasswordResetEmail(user *models.User, token string, expiresIn time.Duration) error {
+	return s.send(user.Email, "Reset your RecipeHub password", "password_reset", map[string]interface{}{
+		"Name":      displayName(user),
+		"Link":      s.link("/reset-password", token),
+		"ExpiresIn": humanDuration(expiresIn),
+	})
+}
+
+func (s *EmailService) SendMagicLinkEmail(user *models.User, token string, expiresIn time.Duration) error {
+	return s.send(user.Email, "Your RecipeHub sign-in link", "magic_link", map[string]interface{}{
+		"Name":      displayName(user),
+		"Link":      s.link("/magic-link", token),
+		"ExpiresIn": humanDuration(expiresIn),
+	})
+}
+
+// SendEmailChangeConfirmation asks the owner of newEmail to confirm it.
+func (s *EmailService) SendEmailChangeConfirmation(user *models.User, newEmail, token string, expiresIn time.Duration) error {
+	return s.send(newEmail, "Confirm your new RecipeHub email", "email_change", map[string]interface{}{
+		"Name":      displayName(user),
+		"NewEmail":  newEmail,
+		"Link":      s.link("/confirm-email-change", token),
+		"ExpiresIn": humanDuration(expiresIn),
+	})
+}
+
+// SendEmailChangeNotice tells the current address that a change to newEmail
+// was requested, in case the request wasn't the account owner's.
+func (s *EmailService) SendEmailChangeNotice(user *models.User, newEmail string) error {
+	return s.send(user.Email, "Your RecipeHub email is being changed", "email_change_notice", map[string]interface{}{
+		"Name":      displayName(user),
+		"NewEmail":  newEmail,
+		"ResetLink": s.baseURL + "/forgot-password",
+	})
+}
+
+func (s *EmailService) SendPurchaseReceipt(user *models.User, recipe *models.Recipe, purchase *models.RecipePurchase) error {
+	return s.send(user.Email, "Your RecipeHub receipt: "+recipe.Title, "purchase_receipt", map[string]interface{}{
+		"Name":        displayName(user),
+		"RecipeTitle": recipe.Title,
+		"Amount":      fmt.Sprintf("%.2f", purchase.Amount),
+		"Currency":    "ETB",
+		"Reference":   purchase.PaymentReference,
+		"Date":        time.Now().Format("January 2, 2006"),
+		"Link":        s.baseURL + "/recipes/" + recipe.ID,
+	})
+}
+
+func (s *EmailService) send(to, subject, template string, data map[string]interface{}) error {
+	var html, text bytes.Buffer
+
+	if err := s.html.ExecuteTemplate(&html, template+".html", data); err != nil {
+		return err
+	}
+	if err := s.text.ExecuteTemplate(&text, template+".txt", data); err != nil {
+		return err
+	}
+
+	return s.mailer.Send(&Email{
+		To:      to,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+}
+
+func (s *EmailService) link(path, token string) string {
+	return s.baseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func displayName(user *models.User) string {
+	if user.FirstName != "" {
+		return user.FirstName
+	}
+	return user.Username
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	case d >= 2*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	case d >= time.Hour:
+		return "1 hour"
+	default:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+}
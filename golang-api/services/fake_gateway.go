@@ -0,0 +1,260 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeGatewayPath is where the fake gateway serves its checkout pages.
+const FakeGatewayPath = "/fake-pay/"
+
+// FakeGateway is a payment provider that runs inside the API, so checkout
+// can be exercised end to end in development and CI without real money. Its
+// checkout page lets the buyer pay or decline, then it fires a signed webhook
+// at the purchase's callback URL and redirects to the return URL, just like
+// a real provider. Payments are kept in memory.
+type FakeGateway struct {
+	baseURL string
+	secret  []byte
+	client  *http.Client
+
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+}
+
+type fakePayment struct {
+	request PaymentRequest
+	status  string
+}
+
+// NewFakeGateway serves checkout pages under API_BASE_URL. Webhooks are
+// signed with FAKE_PAYMENT_SECRET, or a random secret if it isn't set.
+func NewFakeGateway() *FakeGateway {
+	secret := []byte(os.Getenv("FAKE_PAYMENT_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	}
+
+	return &FakeGateway{
+		baseURL:  baseURLFromEnv("API_BASE_URL", "http://localhost:8000"),
+		secret:   secret,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		payments: make(map[string]*fakePayment),
+	}
+}
+
+func (g *FakeGateway) Name() string {
+	return "fake"
+}
+
+func (g *FakeGateway) Initialize(req *PaymentRequest) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, exists := g.payments[req.TxRef]; exists {
+		return "", fmt.Errorf("duplicate transaction reference %s", req.TxRef)
+	}
+	g.payments[req.TxRef] = &fakePayment{request: *req, status: PaymentPending}
+
+	return g.baseURL + FakeGatewayPath + "checkout/" + url.PathEscape(req.TxRef), nil
+}
+
+func (g *FakeGateway) Verify(reference string) (*PaymentResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	payment, ok := g.payments[reference]
+	if !ok {
+		return nil, ErrUnknownPayment
+	}
+
+	return &PaymentResult{
+		Reference: reference,
+		Status:    payment.status,
+		Amount:    payment.request.Amount,
+		Currency:  payment.request.Currency,
+	}, nil
+}
+
+func (g *FakeGateway) Refund(reference string, amount float64, reason string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	payment, ok := g.payments[reference]
+	if !ok {
+		return ErrUnknownPayment
+	}
+	if payment.status != PaymentSucceeded {
+		return fmt.Errorf("refund failed: payment %s is %s", reference, payment.status)
+	}
+	if amount > payment.request.Amount {
+		return fmt.Errorf("refund failed: %.2f is more than was paid", amount)
+	}
+
+	payment.status = "refunded"
+	return nil
+}
+
+// ParseWebhook checks the X-Fake-Signature header, a hex HMAC-SHA256 of the
+// body.
+func (g *FakeGateway) ParseWebhook(header http.Header, body []byte) (*WebhookEvent, error) {
+	got, err := hex.DecodeString(header.Get("X-Fake-Signature"))
+	if err != nil || !hmac.Equal(got, g.sign(body)) {
+		return nil, ErrInvalidWebhookSignature
+	}
+
+	var payload struct {
+		TxRef  string `json:"tx_ref"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.TxRef == "" {
+		return nil, ErrInvalidWebhookPayload
+	}
+
+	return &WebhookEvent{Reference: payload.TxRef, Status: payload.Status}, nil
+}
+
+func (g *FakeGateway) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+var fakeCheckoutPage = htmltemplate.Must(htmltemplate.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif; color: #1f2937; max-width: 480px; margin: 40px auto;">
+  <p style="color: #b45309;">Test payment &mdash; no money is moved.</p>
+  <h2>{{.Description}}</h2>
+  <p><strong>{{printf "%.2f" .Amount}} {{.Currency}}</strong></p>
+  <p>Reference: {{.TxRef}}</p>
+  {{if eq .Status "pending"}}
+  <form method="post">
+    <button name="outcome" value="success" style="background: #16a34a; color: #ffffff; padding: 10px 18px; border: 0; border-radius: 6px;">Pay</button>
+    <button name="outcome" value="failed" style="background: #dc2626; color: #ffffff; padding: 10px 18px; border: 0; border-radius: 6px;">Decline</button>
+  </form>
+  {{else}}
+  <p>This payment is {{.Status}}.</p>
+  {{end}}
+</body>
+</html>
+`))
+
+// ServeHTTP serves the checkout page at FakeGatewayPath + "checkout/<tx_ref>".
+func (g *FakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reference, ok := strings.CutPrefix(r.URL.Path, FakeGatewayPath+"checkout/")
+	if !ok || reference == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	g.mu.Lock()
+	payment, exists := g.payments[reference]
+	var snapshot fakePayment
+	if exists {
+		snapshot = *payment
+	}
+	g.mu.Unlock()
+
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fakeCheckoutPage.Execute(w, map[string]interface{}{
+			"Description": snapshot.request.Description,
+			"Amount":      snapshot.request.Amount,
+			"Currency":    snapshot.request.Currency,
+			"TxRef":       reference,
+			"Status":      snapshot.status,
+		})
+	case http.MethodPost:
+		outcome := r.FormValue("outcome")
+		if outcome != PaymentSucceeded && outcome != PaymentFailed {
+			http.Error(w, "outcome must be success or failed", http.StatusBadRequest)
+			return
+		}
+
+		g.mu.Lock()
+		settled := payment.status != PaymentPending
+		if !settled {
+			payment.status = outcome
+		}
+		g.mu.Unlock()
+
+		if settled {
+			http.Error(w, "payment already "+snapshot.status, http.StatusConflict)
+			return
+		}
+
+		g.notify(&snapshot.request, outcome)
+
+		returnURL := snapshot.request.ReturnURL
+		if returnURL == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		sep := "?"
+		if strings.Contains(returnURL, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, returnURL+sep+"tx_ref="+url.QueryEscape(reference)+"&status="+outcome, http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// notify delivers the webhook before the buyer is redirected, so the
+// purchase is already settled when they get back to the app.
+func (g *FakeGateway) notify(req *PaymentRequest, status string) {
+	if req.CallbackURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"tx_ref": req.TxRef,
+		"status": status,
+	})
+	if err != nil {
+		log.Printf("Fake gateway: failed to encode webhook for %s: %v", req.TxRef, err)
+		return
+	}
+
+	httpReq, err := http.NewRequest("POST", req.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Fake gateway: bad callback URL for %s: %v", req.TxRef, err)
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Fake-Signature", hex.EncodeToString(g.sign(body)))
+
+	resp, err := g.client.Do(httpReq)
+	if err != nil {
+		log.Printf("Fake gateway: webhook for %s failed: %v", req.TxRef, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Fake gateway: webhook for %s got status %d", req.TxRef, resp.StatusCode)
+	}
+}
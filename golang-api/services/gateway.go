@@ -0,0 +1,130 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Payment results as reported by a gateway.
+const (
+	PaymentSucceeded = "success"
+	PaymentPending   = "pending"
+	PaymentFailed    = "failed"
+)
+
+var (
+	ErrWebhookNotConfigured    = errors.New("webhook secret not configured")
+	ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+	ErrInvalidWebhookPayload   = errors.New("invalid webhook payload")
+	ErrUnknownPayment          = errors.New("unknown payment")
+)
+
+// PaymentGateway is a payment provider. Purchases record the gateway's Name
+// as their payment_method, so a purchase is always verified, refunded and
+// notified through the provider it was started with.
+type PaymentGateway interface {
+	Name() string
+	// Initialize starts a checkout for req and returns the URL to send the
+	// buyer to.
+	Initialize(req *PaymentRequest) (string, error)
+	// Verify asks the provider how the payment with the given reference went.
+	Verify(reference string) (*PaymentResult, error)
+	// Refund returns amount of a successful payment to the buyer.
+	Refund(reference string, amount float64, reason string) error
+	// ParseWebhook authenticates a webhook delivery from the raw body and
+	// returns what it is about. It returns ErrWebhookNotConfigured,
+	// ErrInvalidWebhookSignature or ErrInvalidWebhookPayload when the
+	// delivery can't be trusted.
+	ParseWebhook(header http.Header, body []byte) (*WebhookEvent, error)
+}
+
+// PaymentResult is a provider's view of one payment.
+type PaymentResult struct {
+	Reference string
+	Status    string // PaymentSucceeded, PaymentPending or PaymentFailed
+	Amount    float64
+	Currency  string
+}
+
+// WebhookEvent is an authenticated webhook delivery. Its status is only a
+// hint; the payment is always confirmed with Verify.
+type WebhookEvent struct {
+	Reference string
+	Status    string
+}
+
+// PaymentGateways holds the configured gateways by name.
+type PaymentGateways struct {
+	gateways    map[string]PaymentGateway
+	defaultName string
+	apiBaseURL  string
+	appBaseURL  string
+}
+
+// NewPaymentGateways registers gateways and makes defaultName (or the first
+// gateway when it is empty) the one new purchases use unless they ask for
+// another. Webhook URLs are built from API_BASE_URL and return URLs from
+// APP_BASE_URL.
+func NewPaymentGateways(defaultName string, gateways ...PaymentGateway) (*PaymentGateways, error) {
+	if len(gateways) == 0 {
+		return nil, errors.New("no payment gateways configured")
+	}
+
+	registry := &PaymentGateways{
+		gateways:    make(map[string]PaymentGateway, len(gateways)),
+		defaultName: defaultName,
+		apiBaseURL:  baseURLFromEnv("API_BASE_URL", "http://localhost:8000"),
+		appBaseURL:  baseURLFromEnv("APP_BASE_URL", "http://localhost:3000"),
+	}
+	for _, gateway := range gateways {
+		registry.gateways[gateway.Name()] = gateway
+	}
+
+	if registry.defaultName == "" {
+		registry.defaultName = gateways[0].Name()
+	}
+	if _, ok := registry.gateways[registry.defaultName]; !ok {
+		return nil, fmt.Errorf("default payment gateway %q is not configured (have %s)", registry.defaultName, strings.Join(registry.Names(), ", "))
+	}
+
+	return registry, nil
+}
+
+// Get returns the named gateway, or the default one for an empty name.
+func (g *PaymentGateways) Get(name string) (PaymentGateway, bool) {
+	if name == "" {
+		name = g.defaultName
+	}
+	gateway, ok := g.gateways[name]
+	return gateway, ok
+}
+
+func (g *PaymentGateways) Names() []string {
+	names := make([]string, 0, len(g.gateways))
+	for name := range g.gateways {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WebhookURL is where the named gateway should deliver its webhooks.
+func (g *PaymentGateways) WebhookURL(name string) string {
+	return g.apiBaseURL + "/payment/webhook/" + name
+}
+
+// ReturnURL is where buyers land after checkout.
+func (g *PaymentGateways) ReturnURL() string {
+	return g.appBaseURL + "/payment/success"
+}
+
+func baseURLFromEnv(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return strings.TrimRight(value, "/")
+	}
+	return fallback
+}
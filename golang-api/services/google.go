@@ -0,0 +1,149 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const defaultGoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+var (
+	ErrGoogleNotConfigured = errors.New("google sign-in is not configured")
+	ErrInvalidGoogleToken  = errors.New("invalid google token")
+)
+
+// googleIssuers are the two issuer spellings Google uses in ID tokens.
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// GoogleProfile is the verified identity carried by a Google ID token.
+type GoogleProfile struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	Picture       string
+}
+
+// GoogleService verifies Google Sign-In ID tokens locally against Google's
+// published signing keys.
+type GoogleService struct {
+	clientIDs []string
+	keys      *JWKSCache
+}
+
+func NewGoogleService() *GoogleService {
+	jwksURL := os.Getenv("GOOGLE_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = defaultGoogleJWKSURL
+	}
+
+	// Web, Android and iOS apps each have their own client ID, and tokens
+	// from any of them are accepted
+	var clientIDs []string
+	for _, id := range strings.Split(os.Getenv("GOOGLE_CLIENT_ID"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			clientIDs = append(clientIDs, id)
+		}
+	}
+
+	return &GoogleService{
+		clientIDs: clientIDs,
+		keys:      NewJWKSCache(jwksURL),
+	}
+}
+
+type googleClaims struct {
+	Email         string     `json:"email"`
+	EmailVerified googleBool `json:"email_verified"`
+	Name          string     `json:"name"`
+	GivenName     string     `json:"given_name"`
+	FamilyName    string     `json:"family_name"`
+	Picture       string     `json:"picture"`
+	jwt.RegisteredClaims
+}
+
+// googleBool accepts both true and "true"; older tokens used the string form.
+type googleBool bool
+
+func (b *googleBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = googleBool(v)
+	case string:
+		*b = googleBool(v == "true")
+	}
+	return nil
+}
+
+// VerifyIDToken checks the token's signature, audience, issuer and expiry and
+// returns the profile it carries.
+func (s *GoogleService) VerifyIDToken(idToken string) (*GoogleProfile, error) {
+	if len(s.clientIDs) == 0 {
+		return nil, ErrGoogleNotConfigured
+	}
+
+	claims := &googleClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.keys.Key(kid)
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGoogleToken, err)
+	}
+
+	// The parser only checks exp when present; Google always sets it
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: missing exp", ErrInvalidGoogleToken)
+	}
+	if !containsString(googleIssuers, claims.Issuer) {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidGoogleToken, claims.Issuer)
+	}
+	if !audienceMatches(claims.Audience, s.clientIDs) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidGoogleToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidGoogleToken)
+	}
+
+	profile := &GoogleProfile{
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: bool(claims.EmailVerified),
+		FirstName:     claims.GivenName,
+		LastName:      claims.FamilyName,
+		Picture:       claims.Picture,
+	}
+	if profile.FirstName == "" {
+		profile.FirstName = claims.Name
+	}
+
+	return profile, nil
+}
+
+func audienceMatches(audience jwt.ClaimStrings, clientIDs []string) bool {
+	for _, aud := range audience {
+		if containsString(clientIDs, aud) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSMaxAge  = time.Hour
+	minJWKSRefetchWait = time.Minute
+)
+
+var maxAgePattern = regexp.MustCompile(`max-age=(\d+)`)
+
+// JWKSCache fetches an identity provider's RSA signing keys and keeps them
+// for as long as the provider's Cache-Control allows. An unknown kid forces
+// a refetch (at most once a minute) so provider key rotations are picked up.
+// Fetches happen outside the lock, and lookups that need a fetch while one is
+// running wait for that one instead of starting another.
+type JWKSCache struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expiresAt time.Time
+	fetchedAt time.Time
+	inflight  *jwksFetch
+}
+
+// jwksFetch is a fetch in progress; err is set before done is closed.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewJWKSCache(url string) *JWKSCache {
+	return &JWKSCache{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Key returns the public key for kid.
+func (c *JWKSCache) Key(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+
+	now := time.Now()
+	if key, ok := c.keys[kid]; ok && now.Before(c.expiresAt) {
+		c.mu.Unlock()
+		return key, nil
+	}
+
+	stale := c.keys[kid]
+	if now.Before(c.expiresAt) && now.Sub(c.fetchedAt) < minJWKSRefetchWait {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	call := c.inflight
+	if call == nil {
+		call = &jwksFetch{done: make(chan struct{})}
+		c.inflight = call
+		c.mu.Unlock()
+
+		keys, maxAge, err := c.fetch()
+
+		c.mu.Lock()
+		if err == nil {
+			c.keys = keys
+			c.fetchedAt = now
+			c.expiresAt = now.Add(maxAge)
+		}
+		call.err = err
+		c.inflight = nil
+		close(call.done)
+	} else {
+		c.mu.Unlock()
+		<-call.done
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+
+	if call.err != nil {
+		// Fall back to the previous copy if the provider is briefly unreachable
+		if stale != nil {
+			return stale, nil
+		}
+		return nil, call.err
+	}
+
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// fetch downloads the key set and returns it with how long it may be cached.
+func (c *JWKSCache) fetch() (map[string]*rsa.PublicKey, time.Duration, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, 0, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, 0, errors.New("JWKS contains no RSA keys")
+	}
+
+	maxAge := defaultJWKSMaxAge
+	if m := maxAgePattern.FindStringSubmatch(resp.Header.Get("Cache-Control")); m != nil {
+		if seconds, err := strconv.Atoi(m[1]); err == nil {
+			maxAge = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return keys, maxAge, nil
+}
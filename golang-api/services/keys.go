@@ -0,0 +1,315 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one entry of the JWT keyset. Tokens are signed with the
+// active key only; any other key is kept for verification until NotAfter,
+// which gives outstanding tokens a grace window after a rotation.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	NotAfter  time.Time
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Usable reports whether tokens carrying this key's kid are still accepted.
+func (k *SigningKey) Usable(now time.Time) bool {
+	return k.NotAfter.IsZero() || now.Before(k.NotAfter)
+}
+
+type KeySet struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+// keySetConfig is the on-disk (or JWT_KEYS) representation of the keyset:
+//
+//	{
+//	  "active": "2024-11",
+//	  "keys": [
+//	    {"kid": "2024-11", "alg": "HS256", "secret_file": "/run/secrets/jwt-2024-11"},
+//	    {"kid": "2024-10", "alg": "HS256", "secret_file": "/run/secrets/jwt-2024-10", "expires_at": "2024-11-08T00:00:00Z"}
+//	  ]
+//	}
+//
+// RS256 and EdDSA keys use private_key_file (or an inline private_key PEM)
+// instead of a secret. A retired asymmetric key may keep only its
+// public_key_file, since it is never used for signing again.
+type keySetConfig struct {
+	Active string      `json:"active"`
+	Keys   []keyConfig `json:"keys"`
+}
+
+type keyConfig struct {
+	ID             string     `json:"kid"`
+	Algorithm      string     `json:"alg"`
+	Secret         string     `json:"secret"`
+	SecretFile     string     `json:"secret_file"`
+	PrivateKey     string     `json:"private_key"`
+	PrivateKeyFile string     `json:"private_key_file"`
+	PublicKeyFile  string     `json:"public_key_file"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+const minHMACSecretLength = 32
+
+// LoadKeySet builds the keyset from the environment. JWT_KEYS_FILE points at
+// a JSON keyset and JWT_KEYS holds the same JSON inline. JWT_PRIVATE_KEY_FILE
+// (with JWT_ALGORITHM, RS256 by default) and JWT_SECRET (HS256) are
+// single-key shortcuts whose kid is JWT_KEY_ID, or "default" when unset.
+func LoadKeySet() (*KeySet, error) {
+	var raw []byte
+
+	switch {
+	case os.Getenv("JWT_KEYS_FILE") != "":
+		data, err := os.ReadFile(os.Getenv("JWT_KEYS_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("read JWT_KEYS_FILE: %w", err)
+		}
+		raw = data
+	case os.Getenv("JWT_KEYS") != "":
+		raw = []byte(os.Getenv("JWT_KEYS"))
+	case os.Getenv("JWT_PRIVATE_KEY_FILE") != "":
+		kid := os.Getenv("JWT_KEY_ID")
+		if kid == "" {
+			kid = "default"
+		}
+		alg := os.Getenv("JWT_ALGORITHM")
+		if alg == "" {
+			alg = "RS256"
+		}
+		return newKeySet(keySetConfig{
+			Active: kid,
+			Keys:   []keyConfig{{ID: kid, Algorithm: alg, PrivateKeyFile: os.Getenv("JWT_PRIVATE_KEY_FILE")}},
+		})
+	case os.Getenv("JWT_SECRET") != "":
+		kid := os.Getenv("JWT_KEY_ID")
+		if kid == "" {
+			kid = "default"
+		}
+		return newKeySet(keySetConfig{
+			Active: kid,
+			Keys:   []keyConfig{{ID: kid, Algorithm: "HS256", Secret: os.Getenv("JWT_SECRET")}},
+		})
+	default:
+		return nil, errors.New("no JWT signing keys configured: set JWT_KEYS_FILE, JWT_KEYS, JWT_PRIVATE_KEY_FILE or JWT_SECRET")
+	}
+
+	var cfg keySetConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("parse JWT keyset: %w", err)
+	}
+
+	return newKeySet(cfg)
+}
+
+func newKeySet(cfg keySetConfig) (*KeySet, error) {
+	set := &KeySet{keys: make(map[string]*SigningKey)}
+
+	for _, kc := range cfg.Keys {
+		if kc.ID == "" {
+			return nil, errors.New("JWT key without kid")
+		}
+		if _, exists := set.keys[kc.ID]; exists {
+			return nil, fmt.Errorf("duplicate JWT kid %q", kc.ID)
+		}
+
+		key, err := parseKeyConfig(kc)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %q: %w", kc.ID, err)
+		}
+		set.keys[kc.ID] = key
+	}
+
+	active, ok := set.keys[cfg.Active]
+	if !ok {
+		return nil, fmt.Errorf("active JWT kid %q is not in the keyset", cfg.Active)
+	}
+	if !active.Usable(time.Now()) {
+		return nil, fmt.Errorf("active JWT kid %q has expired", cfg.Active)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active JWT kid %q has no private key", cfg.Active)
+	}
+	set.active = active
+
+	return set, nil
+}
+
+func parseKeyConfig(kc keyConfig) (*SigningKey, error) {
+	key := &SigningKey{ID: kc.ID}
+	if kc.ExpiresAt != nil {
+		key.NotAfter = *kc.ExpiresAt
+	}
+
+	alg := strings.ToUpper(kc.Algorithm)
+	if alg == "" {
+		alg = "HS256"
+	}
+
+	switch alg {
+	case "HS256", "HS384", "HS512":
+		secret := []byte(kc.Secret)
+		if kc.SecretFile != "" {
+			data, err := os.ReadFile(kc.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			secret = []byte(strings.TrimSpace(string(data)))
+		}
+		if len(secret) < minHMACSecretLength {
+			return nil, fmt.Errorf("HMAC secret must be at least %d bytes", minHMACSecretLength)
+		}
+		key.Method = jwt.GetSigningMethod(alg)
+		key.signKey = secret
+		key.verifyKey = secret
+	case "RS256", "RS384", "RS512":
+		key.Method = jwt.GetSigningMethod(alg)
+		if err := loadAsymmetricKey(key, kc); err != nil {
+			return nil, err
+		}
+	case "EDDSA":
+		key.Method = jwt.SigningMethodEdDSA
+		if err := loadAsymmetricKey(key, kc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Algorithm)
+	}
+
+	return key, nil
+}
+
+func loadAsymmetricKey(key *SigningKey, kc keyConfig) error {
+	_, isRSA := key.Method.(*jwt.SigningMethodRSA)
+
+	privatePEM := []byte(kc.PrivateKey)
+	if kc.PrivateKeyFile != "" {
+		data, err := os.ReadFile(kc.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		privatePEM = data
+	}
+
+	if len(privatePEM) > 0 {
+		var private crypto.PrivateKey
+		var err error
+		if isRSA {
+			private, err = jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+		} else {
+			private, err = jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+		}
+		if err != nil {
+			return fmt.Errorf("parse private key: %w", err)
+		}
+		key.signKey = private
+		key.verifyKey = private.(crypto.Signer).Public()
+		return nil
+	}
+
+	if kc.PublicKeyFile == "" {
+		return errors.New("private_key_file or public_key_file required")
+	}
+	publicPEM, err := os.ReadFile(kc.PublicKeyFile)
+	if err != nil {
+		return err
+	}
+	if isRSA {
+		key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+	} else {
+		key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(publicPEM)
+	}
+	if err != nil {
+		return fmt.Errorf("parse public key: %w", err)
+	}
+
+	return nil
+}
+
+// Active returns the key new tokens are signed with.
+func (ks *KeySet) Active() *SigningKey {
+	return ks.active
+}
+
+// Lookup returns the key for kid if it is still inside its grace window.
+func (ks *KeySet) Lookup(kid string) (*SigningKey, error) {
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if !key.Usable(time.Now()) {
+		return nil, fmt.Errorf("signing key %q has been retired", kid)
+	}
+	return key, nil
+}
+
+// JWK is the public half of a signing key in RFC 7517 form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS publishes the public keys of every asymmetric key still inside its
+// grace window. HMAC secrets are never included.
+func (ks *KeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	now := time.Now()
+
+	for _, key := range ks.keys {
+		if !key.Usable(now) {
+			continue
+		}
+
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "RSA",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: key.Method.Alg(),
+				N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: key.Method.Alg(),
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+
+	return set
+}
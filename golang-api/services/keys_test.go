@@ -0,0 +1,155 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	testSecretOld = strings.Repeat("o", minHMACSecretLength)
+	testSecretNew = strings.Repeat("n", minHMACSecretLength)
+)
+
+func mustKeySet(t *testing.T, cfg keySetConfig) *KeySet {
+	t.Helper()
+	set, err := newKeySet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestNewKeySetRejectsBadConfig(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		cfg  keySetConfig
+	}{
+		{"key without kid", keySetConfig{Active: "", Keys: []keyConfig{{Secret: testSecretNew}}}},
+		{"duplicate kid", keySetConfig{Active: "a", Keys: []keyConfig{{ID: "a", Secret: testSecretNew}, {ID: "a", Secret: testSecretOld}}}},
+		{"unknown active kid", keySetConfig{Active: "b", Keys: []keyConfig{{ID: "a", Secret: testSecretNew}}}},
+		{"expired active kid", keySetConfig{Active: "a", Keys: []keyConfig{{ID: "a", Secret: testSecretNew, ExpiresAt: &past}}}},
+		{"short secret", keySetConfig{Active: "a", Keys: []keyConfig{{ID: "a", Secret: "too-short"}}}},
+		{"unsupported algorithm", keySetConfig{Active: "a", Keys: []keyConfig{{ID: "a", Algorithm: "none", Secret: testSecretNew}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newKeySet(tt.cfg); err == nil {
+				t.Error("keyset accepted")
+			}
+		})
+	}
+}
+
+func TestKeySetLookup(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	set := mustKeySet(t, keySetConfig{
+		Active: "new",
+		Keys: []keyConfig{
+			{ID: "new", Secret: testSecretNew},
+			{ID: "rotated", Secret: testSecretOld, ExpiresAt: &future},
+			{ID: "retired", Secret: testSecretOld, ExpiresAt: &past},
+		},
+	})
+
+	tests := []struct {
+		kid    string
+		wantOK bool
+	}{
+		{"new", true},
+		{"rotated", true},
+		{"retired", false},
+		{"unknown", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		key, err := set.Lookup(tt.kid)
+		if tt.wantOK && (err != nil || key.ID != tt.kid) {
+			t.Errorf("Lookup(%q) = %v, %v", tt.kid, key, err)
+		}
+		if !tt.wantOK && err == nil {
+			t.Errorf("Lookup(%q) found key %q", tt.kid, key.ID)
+		}
+	}
+}
+
+func TestValidateTokenAcrossRotation(t *testing.T) {
+	signWith := func(set *KeySet) string {
+		t.Helper()
+		token, err := (&AuthService{keys: set}).sign(&Claims{
+			UserID: "user-1",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	before := mustKeySet(t, keySetConfig{Active: "old", Keys: []keyConfig{{ID: "old", Secret: testSecretOld}}})
+	issued := signWith(before)
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		set    *KeySet
+		wantOK bool
+	}{
+		{"same key", before, true},
+		{"rotated within grace window", mustKeySet(t, keySetConfig{
+			Active: "new",
+			Keys:   []keyConfig{{ID: "new", Secret: testSecretNew}, {ID: "old", Secret: testSecretOld, ExpiresAt: &future}},
+		}), true},
+		{"rotated key retired", mustKeySet(t, keySetConfig{
+			Active: "new",
+			Keys:   []keyConfig{{ID: "new", Secret: testSecretNew}, {ID: "old", Secret: testSecretOld, ExpiresAt: &past}},
+		}), false},
+		{"rotated key removed", mustKeySet(t, keySetConfig{
+			Active: "new",
+			Keys:   []keyConfig{{ID: "new", Secret: testSecretNew}},
+		}), false},
+		{"kid reused with another secret", mustKeySet(t, keySetConfig{
+			Active: "old",
+			Keys:   []keyConfig{{ID: "old", Secret: testSecretNew}},
+		}), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := (&AuthService{keys: tt.set}).ValidateToken(issued)
+			if tt.wantOK && (err != nil || claims.UserID != "user-1") {
+				t.Errorf("token rejected: %v", err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+}
+
+func TestValidateTokenRejectsAlgorithmMismatch(t *testing.T) {
+	set := mustKeySet(t, keySetConfig{Active: "a", Keys: []keyConfig{{ID: "a", Algorithm: "HS512", Secret: testSecretNew}}})
+
+	// Same kid and secret, but not the algorithm configured for the kid
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: "user-1"})
+	token.Header["kid"] = "a"
+	signed, err := token.SignedString([]byte(testSecretNew))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&AuthService{keys: set}).ValidateToken(signed); err == nil {
+		t.Error("token signed with another algorithm accepted")
+	}
+}
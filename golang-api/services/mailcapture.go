@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// CapturedMessage is one message accepted by a CaptureServer.
+type CapturedMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// Subject returns the decoded Subject header of the message.
+func (m CapturedMessage) Subject() string {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return ""
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return msg.Header.Get("Subject")
+	}
+	return subject
+}
+
+// CaptureServer is a minimal local SMTP server that keeps every message in
+// memory instead of delivering it. Point SMTP_HOST/SMTP_PORT at it (with
+// MAIL_BACKEND=smtp) to exercise the real SMTP path in tests and assert on
+// Messages().
+type CaptureServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []CapturedMessage
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// StartCaptureServer listens on addr, e.g. "127.0.0.1:0" for a free port.
+func StartCaptureServer(addr string) (*CaptureServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CaptureServer{listener: listener, conns: make(map[net.Conn]struct{})}
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *CaptureServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *CaptureServer) Messages() []CapturedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CapturedMessage(nil), s.messages...)
+}
+
+func (s *CaptureServer) Reset() {
+	s.mu.Lock()
+	s.messages = nil
+	s.mu.Unlock()
+}
+
+// Close stops the server and drops any client still connected, so a client
+// that never sends QUIT can't keep it open.
+func (s *CaptureServer) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *CaptureServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *CaptureServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) bool {
+		return text.PrintfLine(format, args...) == nil
+	}
+
+	if !reply("220 recipehub capture ESMTP") {
+		return
+	}
+
+	var current CapturedMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			text.PrintfLine("250-recipehub capture")
+			reply("250 8BITMIME")
+		case "HELO":
+			reply("250 recipehub capture")
+		case "MAIL":
+			current = CapturedMessage{From: smtpPath(arg)}
+			reply("250 OK")
+		case "RCPT":
+			current.To = append(current.To, smtpPath(arg))
+			reply("250 OK")
+		case "DATA":
+			if !reply("354 End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			current.Data = data
+
+			s.mu.Lock()
+			s.messages = append(s.messages, current)
+			s.mu.Unlock()
+
+			current = CapturedMessage{}
+			reply("250 OK")
+		case "RSET":
+			current = CapturedMessage{}
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// smtpPath extracts the address from "FROM:<a@b>" / "TO:<a@b>".
+func smtpPath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path = strings.TrimSpace(path)
+	if i := strings.IndexByte(path, ' '); i >= 0 {
+		path = path[:i]
+	}
+	return strings.Trim(path, "<>")
+}
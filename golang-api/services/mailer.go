@@ -0,0 +1,205 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Email is a rendered message with plain text and HTML alternatives.
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers rendered emails. SMTPMailer is used in production;
+// FileMailer and LogMailer keep mail local for development and tests.
+type Mailer interface {
+	Send(msg *Email) error
+}
+
+// NewMailer returns the backend named by MAIL_BACKEND ("smtp", "file" or
+// "log"). There is no default: the file and log backends keep reset and
+// sign-in links readable on the server, so they must be chosen explicitly,
+// and a missing or misspelled backend stops the server.
+func NewMailer() Mailer {
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "smtp":
+		return NewSMTPMailer()
+	case "file":
+		return NewFileMailer()
+	case "log":
+		return NewLogMailer()
+	case "":
+		log.Fatalf("MAIL_BACKEND is not set; use smtp, or file or log for development")
+	default:
+		log.Fatalf("Unknown MAIL_BACKEND %q; use smtp, file or log", backend)
+	}
+	return nil
+}
+
+func mailFrom() string {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "RecipeHub <no-reply@recipehub.local>"
+	}
+	return from
+}
+
+type SMTPMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+func NewSMTPMailer() *SMTPMailer {
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	return &SMTPMailer{
+		host:     os.Getenv("SMTP_HOST"),
+		port:     port,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     mailFrom(),
+	}
+}
+
+func (m *SMTPMailer) Send(msg *Email) error {
+	data, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	sender, err := mailAddress(m.from)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.host+":"+m.port, auth, sender, []string{msg.To}, data)
+}
+
+// FileMailer writes every message as an .eml file into MAIL_DIR.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer() *FileMailer {
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" {
+		dir = "./mail"
+	}
+	os.MkdirAll(dir, 0755)
+
+	return &FileMailer{
+		dir:  dir,
+		from: mailFrom(),
+	}
+}
+
+func (m *FileMailer) Send(msg *Email) error {
+	data, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102T150405"), uuid.New().String()[:8])
+	return os.WriteFile(filepath.Join(m.dir, filename), data, 0644)
+}
+
+// LogMailer prints the plain text part of every message to the server log.
+type LogMailer struct{}
+
+func NewLogMailer() *LogMailer {
+	return &LogMailer{}
+}
+
+func (m *LogMailer) Send(msg *Email) error {
+	log.Printf("[mail] to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+// mailAddress extracts the bare address from a MAIL_FROM value such as
+// "RecipeHub <no-reply@example.com>" for the SMTP envelope.
+func mailAddress(from string) (string, error) {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid MAIL_FROM %q: %w", from, err)
+	}
+	return addr.Address, nil
+}
+
+// buildMessage renders msg as a multipart/alternative MIME message.
+func buildMessage(from string, msg *Email) ([]byte, error) {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "From: %s\r\n", from)
+	fmt.Fprintf(&out, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&out, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Message-ID: <%s@recipehub>\r\n", uuid.New().String())
+	fmt.Fprintf(&out, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", body.Boundary())
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+
+	for _, p := range parts {
+		if p.content == "" {
+			continue
+		}
+
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(p.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	out.Write(buf.Bytes())
+	return out.Bytes(), nil
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSMTPMailerDeliversToCaptureServer(t *testing.T) {
+	server, err := StartCaptureServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SMTP_HOST", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("SMTP_USERNAME", "")
+	t.Setenv("MAIL_FROM", "RecipeHub <no-reply@recipehub.test>")
+
+	err = NewSMTPMailer().Send(&Email{
+		To:      "cook@example.com",
+		Subject: "Réinitialiser votre mot de passe",
+		Text:    "Reset link: https://recipehub.test/reset-password?token=abc",
+		HTML:    "<p>Reset link</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("captured %d messages, want 1", len(messages))
+	}
+	msg := messages[0]
+
+	if msg.From != "no-reply@recipehub.test" {
+		t.Errorf("envelope from is %q", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "cook@example.com" {
+		t.Errorf("envelope recipients are %v", msg.To)
+	}
+	if got := msg.Subject(); got != "Réinitialiser votre mot de passe" {
+		t.Errorf("subject is %q", got)
+	}
+	if !strings.Contains(string(msg.Data), "token=3Dabc") && !strings.Contains(string(msg.Data), "token=abc") {
+		t.Errorf("message is missing the link:\n%s", msg.Data)
+	}
+}
+
+func TestCaptureServerCloseDropsIdleClients(t *testing.T) {
+	server, err := StartCaptureServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the greeting so the connection is being served
+	if _, err := conn.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is still waiting for a connected client")
+	}
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2Params are the argon2id cost parameters for new password hashes.
+// Every hash records the parameters it was made with, so raising them only
+// affects new hashes; older ones are upgraded as users log in.
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow RFC 9106's recommendation for memory-constrained
+// environments (64 MiB).
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// LoadArgon2Params reads ARGON2_MEMORY (KiB), ARGON2_ITERATIONS and
+// ARGON2_PARALLELISM, falling back to DefaultArgon2Params.
+func LoadArgon2Params() (Argon2Params, error) {
+	params := DefaultArgon2Params
+
+	for _, setting := range []struct {
+		name  string
+		value *uint32
+	}{
+		{"ARGON2_MEMORY", &params.Memory},
+		{"ARGON2_ITERATIONS", &params.Iterations},
+	} {
+		if raw := os.Getenv(setting.name); raw != "" {
+			v, err := strconv.ParseUint(raw, 10, 32)
+			if err != nil || v == 0 {
+				return params, fmt.Errorf("invalid %s %q", setting.name, raw)
+			}
+			*setting.value = uint32(v)
+		}
+	}
+
+	if raw := os.Getenv("ARGON2_PARALLELISM"); raw != "" {
+		v, err := strconv.ParseUint(raw, 10, 8)
+		if err != nil || v == 0 {
+			return params, fmt.Errorf("invalid ARGON2_PARALLELISM %q", raw)
+		}
+		params.Parallelism = uint8(v)
+	}
+
+	if params.Memory < 8*uint32(params.Parallelism) {
+		return params, fmt.Errorf("ARGON2_MEMORY must be at least 8 KiB per lane")
+	}
+
+	return params, nil
+}
+
+// HashPassword returns an argon2id hash in PHC string format.
+func (s *AuthService) HashPassword(password string) (string, error) {
+	p := s.argon2
+
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// CheckPassword verifies a password against an argon2id or a legacy bcrypt
+// hash. Accounts without a password (empty hash) never match.
+func (s *AuthService) CheckPassword(password, hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		return subtle.ConstantTimeCompare(computed, key) == 1
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	default:
+		return false
+	}
+}
+
+// CheckMissingPassword does the work of a password check without a hash to
+// check against, so a login for an unknown email takes as long as one with a
+// wrong password and doesn't reveal which emails are registered.
+func (s *AuthService) CheckMissingPassword(password string) {
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, _ = s.HashPassword("not the password")
+	})
+	s.CheckPassword(password, s.dummyHash)
+}
+
+// NeedsRehash reports whether a hash that just verified should be replaced:
+// it is bcrypt, or argon2id with parameters other than the current ones.
+func (s *AuthService) NeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return true
+	}
+
+	params, _, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	current := s.argon2
+	return params.Memory != current.Memory ||
+		params.Iterations != current.Iterations ||
+		params.Parallelism != current.Parallelism ||
+		uint32(len(key)) != current.KeyLength
+}
+
+// decodeArgon2Hash parses "$argon2id$v=19$m=...,t=...,p=...$salt$key".
+func decodeArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError is one problem with one request field, for the frontend to show
+// next to that field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	PasswordTooShort         = "too_short"
+	PasswordTooLong          = "too_long"
+	PasswordContainsEmail    = "contains_email"
+	PasswordContainsUsername = "contains_username"
+	PasswordBreached         = "breached"
+)
+
+// PasswordPolicy decides whether a new password is acceptable.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	breached  *BreachDirectory
+}
+
+// NewPasswordPolicy reads PASSWORD_MIN_LENGTH (default 8) and
+// PASSWORD_BREACH_DIR. The breached-password check is skipped when no
+// directory is configured.
+func NewPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength: 8,
+		MaxLength: 128,
+	}
+
+	if raw := os.Getenv("PASSWORD_MIN_LENGTH"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			policy.MinLength = n
+		} else {
+			log.Printf("Ignoring invalid PASSWORD_MIN_LENGTH %q", raw)
+		}
+	}
+
+	if dir := os.Getenv("PASSWORD_BREACH_DIR"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Printf("PASSWORD_BREACH_DIR %q is not a readable directory; breached password check disabled", dir)
+		} else {
+			policy.breached = NewBreachDirectory(dir)
+		}
+	}
+
+	return policy
+}
+
+// Check returns every way password breaks the policy for the account with
+// the given email and username; an empty result means it is acceptable.
+func (p *PasswordPolicy) Check(password, email, username string) []FieldError {
+	var violations []FieldError
+	add := func(code, message string) {
+		violations = append(violations, FieldError{Field: "password", Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add(PasswordTooShort, "Password must be at least "+strconv.Itoa(p.MinLength)+" characters")
+	}
+	if length > p.MaxLength {
+		add(PasswordTooLong, "Password must be at most "+strconv.Itoa(p.MaxLength)+" characters")
+	}
+
+	lower := strings.ToLower(password)
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if len(local) >= 3 && strings.Contains(lower, local) {
+		add(PasswordContainsEmail, "Password must not contain your email address")
+	}
+	if name := strings.ToLower(username); len(name) >= 3 && strings.Contains(lower, name) {
+		add(PasswordContainsUsername, "Password must not contain your username")
+	}
+
+	if p.breached != nil && length > 0 {
+		found, err := p.breached.Contains(password)
+		if err != nil {
+			// An unreadable list shouldn't stop people from signing up
+			log.Printf("Breached password check failed: %v", err)
+		} else if found {
+			add(PasswordBreached, "This password has appeared in a data breach. Please choose a different one.")
+		}
+	}
+
+	return violations
+}
+
+// ValidatePassword checks a new password for the account with the given
+// email and username against the configured policy.
+func (s *AuthService) ValidatePassword(password, email, username string) []FieldError {
+	return s.policy.Check(password, email, username)
+}
+
+// BreachDirectory checks passwords against a local copy of a breached
+// password corpus in the Have I Been Pwned k-anonymity range format: one
+// file per 5-character SHA-1 prefix (e.g. "21BD1" or "21BD1.txt"), each line
+// holding the remaining 35 characters, optionally followed by ":count".
+// Only the file for the password's prefix is read per check, so the full
+// corpus never has to fit in memory.
+type BreachDirectory struct {
+	dir string
+}
+
+func NewBreachDirectory(dir string) *BreachDirectory {
+	return &BreachDirectory{dir: dir}
+}
+
+func (b *BreachDirectory) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		file, err = os.Open(filepath.Join(b.dir, prefix))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// No file means no breached password with this prefix
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 8, MaxLength: 16}
+
+	tests := []struct {
+		name     string
+		password string
+		email    string
+		username string
+		want     []string
+	}{
+		{"acceptable", "correct horse", "cook@example.com", "chef_abebe", nil},
+		{"too short", "short", "cook@example.com", "chef_abebe", []string{PasswordTooShort}},
+		{"too short in runes", "ሰላምሰላም", "cook@example.com", "chef_abebe", []string{PasswordTooShort}},
+		{"too long", strings.Repeat("x", 17), "cook@example.com", "chef_abebe", []string{PasswordTooLong}},
+		{"contains email name", "mycook!pass", "Cook@example.com", "chef_abebe", []string{PasswordContainsEmail}},
+		{"short email name is ignored", "ab-secret-pw", "ab@example.com", "chef_abebe", nil},
+		{"contains username", "x-CHEF_ABEBE-x", "cook@example.com", "chef_abebe", []string{PasswordContainsUsername}},
+		{"every violation", "cook", "cook@example.com", "cook", []string{PasswordTooShort, PasswordContainsEmail, PasswordContainsUsername}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, violation := range policy.Check(tt.password, tt.email, tt.username) {
+				if violation.Field != "password" {
+					t.Errorf("violation %q is for field %q", violation.Code, violation.Field)
+				}
+				if violation.Message == "" {
+					t.Errorf("violation %q has no message", violation.Code)
+				}
+				got = append(got, violation.Code)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("codes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyRejectsBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("password123"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	corpus := "0000000000000000000000000000000000A:3\r\n" + strings.ToLower(hash[5:]) + ":24230577\r\n"
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(corpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &PasswordPolicy{MinLength: 8, MaxLength: 128, breached: NewBreachDirectory(dir)}
+
+	tests := []struct {
+		password string
+		want     []string
+	}{
+		{"password123", []string{PasswordBreached}},
+		{"password124", nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, violation := range policy.Check(tt.password, "cook@example.com", "chef_abebe") {
+			got = append(got, violation.Code)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: codes = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	PhoneOTPTTL         = 5 * time.Minute
+	PhoneOTPMaxAttempts = 5
+)
+
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// NormalizePhone returns raw in E.164 form ("+251911234567"). Spaces, dashes,
+// dots and brackets are ignored, a leading "00" is read as "+", and numbers
+// in national format (leading "0") get PHONE_DEFAULT_COUNTRY_CODE, which
+// defaults to Ethiopia's 251.
+func NormalizePhone(raw string) (string, error) {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(raw) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	number := b.String()
+
+	switch {
+	case strings.HasPrefix(number, "+"):
+	case strings.HasPrefix(number, "00"):
+		number = "+" + number[2:]
+	case strings.HasPrefix(number, "0"):
+		countryCode := os.Getenv("PHONE_DEFAULT_COUNTRY_CODE")
+		if countryCode == "" {
+			countryCode = "251"
+		}
+		number = "+" + strings.TrimPrefix(countryCode, "+") + number[1:]
+	default:
+		return "", ErrInvalidPhone
+	}
+
+	// E.164 allows at most 15 digits; anything under 8 isn't a real number
+	digits := len(number) - 1
+	if digits < 8 || digits > 15 || number[1] == '0' {
+		return "", ErrInvalidPhone
+	}
+
+	return number, nil
+}
+
+// IssuePhoneOTP creates a 6-digit login code for phone and returns it. Only
+// its digest is stored, and it replaces any earlier code for the number.
+func (s *AuthService) IssuePhoneOTP(phone string) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	if err := s.db.SavePhoneOTP(phone, hashPhoneOTP(phone, code), PhoneOTPTTL); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// VerifyPhoneOTP redeems the live code for phone. Every attempt counts, and
+// a code is dead after PhoneOTPMaxAttempts wrong guesses.
+func (s *AuthService) VerifyPhoneOTP(phone, code string) (bool, error) {
+	stored, err := s.db.UsePhoneOTPAttempt(phone, PhoneOTPMaxAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	expected := hashPhoneOTP(phone, strings.TrimSpace(code))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(stored)) != 1 {
+		return false, nil
+	}
+
+	// Deleting the row is what makes the code single-use
+	return s.db.DeletePhoneOTP(phone, stored)
+}
+
+func hashPhoneOTP(phone, code string) string {
+	sum := sha256.Sum256([]byte(phone + "\x00" + code))
+	return hex.EncodeToString(sum[:])
+}
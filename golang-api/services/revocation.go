@@ -0,0 +1,103 @@
+package services
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+	"time"
+)
+
+// RevocationStore records access tokens (by jti) that were revoked before
+// they expired. An entry only has to outlive the token it revokes, so stores
+// drop entries once expiresAt has passed.
+type RevocationStore interface {
+	Revoke(jti string, expiresAt time.Time) error
+	IsRevoked(jti string) (bool, error)
+}
+
+// NewRevocationStore picks the store named by TOKEN_REVOCATION_STORE:
+// "memory" for a single instance or development, "postgres" (the default)
+// when several API instances need to agree.
+func NewRevocationStore(dbService *DatabaseService) RevocationStore {
+	if os.Getenv("TOKEN_REVOCATION_STORE") == "memory" {
+		return NewMemoryRevocationStore()
+	}
+	return NewPostgresRevocationStore(dbService)
+}
+
+type MemoryRevocationStore struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		entries: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryRevocationStore) Revoke(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range s.entries {
+		if !now.Before(exp) {
+			delete(s.entries, id)
+		}
+	}
+
+	if now.Before(expiresAt) {
+		s.entries[jti] = expiresAt
+	}
+
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp, ok := s.entries[jti]
+	if !ok {
+		return false, nil
+	}
+	if !time.Now().Before(exp) {
+		delete(s.entries, jti)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+type PostgresRevocationStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRevocationStore(dbService *DatabaseService) *PostgresRevocationStore {
+	return &PostgresRevocationStore{db: dbService.db}
+}
+
+func (s *PostgresRevocationStore) Revoke(jti string, expiresAt time.Time) error {
+	// Expired entries can never match a valid token again
+	if _, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= NOW()`); err != nil {
+		return err
+	}
+
+	// Stored as time left rather than a Go timestamp, so the entry expires by
+	// the same clock and time zone as the NOW() it is checked against
+	query := `
+		INSERT INTO revoked_tokens (jti, expires_at)
+		VALUES ($1, NOW() + make_interval(secs => $2))
+		ON CONFLICT (jti) DO NOTHING
+	`
+	_, err := s.db.Exec(query, jti, time.Until(expiresAt).Seconds())
+	return err
+}
+
+func (s *PostgresRevocationStore) IsRevoked(jti string) (bool, error) {
+	var revoked bool
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1 AND expires_at > NOW())`
+	err := s.db.QueryRow(query, jti).Scan(&revoked)
+	return revoked, err
+}
@@ -0,0 +1,27 @@
+package services
+
+import "errors"
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// AssignableRoles are the roles that can be granted on top of DefaultRole,
+// which every account has implicitly.
+var AssignableRoles = []string{RoleAdmin, RoleModerator}
+
+var ErrUnknownRole = errors.New("unknown role")
+
+func IsAssignableRole(role string) bool {
+	return containsString(AssignableRoles, role)
+}
+
+// HasRole reports whether the token grants role. A token without the Hasura
+// namespace only carries DefaultRole.
+func (c *Claims) HasRole(role string) bool {
+	if c.Hasura == nil {
+		return role == DefaultRole
+	}
+	return c.Hasura.HasRole(HasuraRole(role))
+}
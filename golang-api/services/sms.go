@@ -0,0 +1,156 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMS is a text message to one phone number.
+type SMS struct {
+	To   string
+	Body string
+}
+
+// SMSSender delivers text messages. TwilioSMSSender is used in production;
+// LogSMSSender and FakeSMSSender keep messages local for development and
+// tests.
+type SMSSender interface {
+	Send(msg *SMS) error
+}
+
+// NewSMSSender returns the backend named by SMS_BACKEND ("twilio", "log" or
+// "fake"). There is no default: the log and fake backends never deliver the
+// codes and the log backend writes them to the server log, so they must be
+// chosen explicitly, and a missing or misspelled backend stops the server.
+func NewSMSSender() SMSSender {
+	switch backend := os.Getenv("SMS_BACKEND"); backend {
+	case "twilio":
+		return NewTwilioSMSSender()
+	case "log":
+		return NewLogSMSSender()
+	case "fake":
+		return NewFakeSMSSender()
+	case "":
+		log.Fatalf("SMS_BACKEND is not set; use twilio, or log or fake for development")
+	default:
+		log.Fatalf("Unknown SMS_BACKEND %q; use twilio, log or fake", backend)
+	}
+	return nil
+}
+
+// TwilioSMSSender sends messages through Twilio's Messages API.
+type TwilioSMSSender struct {
+	accountSID string
+	authToken  string
+	from       string
+	baseURL    string
+	client     *http.Client
+}
+
+// NewTwilioSMSSender reads TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and
+// TWILIO_FROM (a Twilio number or messaging service SID). TWILIO_BASE_URL
+// overrides the API base URL, e.g. for a local mock.
+func NewTwilioSMSSender() *TwilioSMSSender {
+	sender := &TwilioSMSSender{
+		accountSID: os.Getenv("TWILIO_ACCOUNT_SID"),
+		authToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
+		from:       os.Getenv("TWILIO_FROM"),
+		baseURL:    baseURLFromEnv("TWILIO_BASE_URL", "https://api.twilio.com"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if sender.accountSID == "" || sender.authToken == "" || sender.from == "" {
+		log.Fatalf("SMS_BACKEND=twilio needs TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM")
+	}
+	return sender
+}
+
+func (s *TwilioSMSSender) Send(msg *SMS) error {
+	form := url.Values{}
+	form.Set("To", msg.To)
+	form.Set("Body", msg.Body)
+	if strings.HasPrefix(s.from, "MG") {
+		form.Set("MessagingServiceSid", s.from)
+	} else {
+		form.Set("From", s.from)
+	}
+
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", s.baseURL, url.PathEscape(s.accountSID))
+	httpReq, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	httpReq.SetBasicAuth(s.accountSID, s.authToken)
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var twilioErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&twilioErr)
+		return fmt.Errorf("sms delivery failed: %d %s", resp.StatusCode, twilioErr.Message)
+	}
+
+	return nil
+}
+
+type LogSMSSender struct{}
+
+func NewLogSMSSender() *LogSMSSender {
+	return &LogSMSSender{}
+}
+
+func (s *LogSMSSender) Send(msg *SMS) error {
+	log.Printf("[sms] to=%s\n%s", msg.To, msg.Body)
+	return nil
+}
+
+// FakeSMSSender keeps sent messages in memory so tests can read the codes
+// back.
+type FakeSMSSender struct {
+	mu       sync.Mutex
+	messages []SMS
+}
+
+func NewFakeSMSSender() *FakeSMSSender {
+	return &FakeSMSSender{}
+}
+
+func (s *FakeSMSSender) Send(msg *SMS) error {
+	s.mu.Lock()
+	s.messages = append(s.messages, *msg)
+	s.mu.Unlock()
+	return nil
+}
+
+// Messages returns everything sent so far, oldest first.
+func (s *FakeSMSSender) Messages() []SMS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SMS(nil), s.messages...)
+}
+
+// Last returns the latest message sent to the given number.
+func (s *FakeSMSSender) Last(to string) (SMS, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].To == to {
+			return s.messages[i], true
+		}
+	}
+	return SMS{}, false
+}
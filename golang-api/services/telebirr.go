@@ -0,0 +1,488 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TelebirrService is the "telebirr" PaymentGateway, using Telebirr's H5 web
+// checkout. Every request and notification is signed with SHA256WithRSA
+// (RSA-PSS): ours with the merchant private key, Telebirr's with the public
+// key from the merchant portal.
+type TelebirrService struct {
+	baseURL     string
+	checkoutURL string
+	fabricAppID string
+	appSecret   string
+	appID       string
+	merchCode   string
+	privateKey  *rsa.PrivateKey
+	publicKey   *rsa.PublicKey
+	client      *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	inflight    *telebirrTokenFetch
+}
+
+// telebirrTokenFetch is a token request in progress; token and err are set
+// before done is closed.
+type telebirrTokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// TelebirrConfigured reports whether Telebirr credentials are set, so the
+// gateway is only offered when it can be used.
+func TelebirrConfigured() bool {
+	return os.Getenv("TELEBIRR_MERCHANT_APP_ID") != ""
+}
+
+// NewTelebirrService reads TELEBIRR_FABRIC_APP_ID, TELEBIRR_APP_SECRET,
+// TELEBIRR_MERCHANT_APP_ID, TELEBIRR_MERCHANT_CODE, TELEBIRR_PRIVATE_KEY_FILE
+// and TELEBIRR_PUBLIC_KEY_FILE, plus the API and checkout page URLs in
+// TELEBIRR_BASE_URL and TELEBIRR_CHECKOUT_URL. The URLs have no default, so
+// a deploy can't end up on the sandbox (or production) by accident.
+func NewTelebirrService() *TelebirrService {
+	for _, name := range []string{"TELEBIRR_BASE_URL", "TELEBIRR_CHECKOUT_URL"} {
+		if os.Getenv(name) == "" {
+			panic(name + " is required when Telebirr is configured")
+		}
+	}
+
+	s := &TelebirrService{
+		baseURL:     baseURLFromEnv("TELEBIRR_BASE_URL", ""),
+		checkoutURL: baseURLFromEnv("TELEBIRR_CHECKOUT_URL", ""),
+		fabricAppID: os.Getenv("TELEBIRR_FABRIC_APP_ID"),
+		appSecret:   os.Getenv("TELEBIRR_APP_SECRET"),
+		appID:       os.Getenv("TELEBIRR_MERCHANT_APP_ID"),
+		merchCode:   os.Getenv("TELEBIRR_MERCHANT_CODE"),
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+
+	privatePEM, err := os.ReadFile(os.Getenv("TELEBIRR_PRIVATE_KEY_FILE"))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read TELEBIRR_PRIVATE_KEY_FILE: %v", err))
+	}
+	s.privateKey, err = jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse Telebirr private key: %v", err))
+	}
+
+	// Without Telebirr's public key notifications are refused, but checkout
+	// and verification still work
+	if path := os.Getenv("TELEBIRR_PUBLIC_KEY_FILE"); path != "" {
+		publicPEM, err := os.ReadFile(path)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to read TELEBIRR_PUBLIC_KEY_FILE: %v", err))
+		}
+		s.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to parse Telebirr public key: %v", err))
+		}
+	}
+
+	return s
+}
+
+func (s *TelebirrService) Name() string {
+	return "telebirr"
+}
+
+// telebirrResponse is the envelope of every signed Telebirr API response.
+type telebirrResponse struct {
+	Result     string          `json:"result"`
+	Code       string          `json:"code"`
+	Msg        string          `json:"msg"`
+	ErrorCode  string          `json:"errorCode"`
+	ErrorMsg   string          `json:"errorMsg"`
+	BizContent json.RawMessage `json:"biz_content"`
+}
+
+func (s *TelebirrService) Initialize(req *PaymentRequest) (string, error) {
+	var order struct {
+		PrepayID string `json:"prepay_id"`
+	}
+	err := s.call("/payment/v1/merchant/preOrder", "payment.preorder", map[string]string{
+		"notify_url":            req.CallbackURL,
+		"redirect_url":          req.ReturnURL,
+		"appid":                 s.appID,
+		"merch_code":            s.merchCode,
+		"merch_order_id":        req.TxRef,
+		"trade_type":            "Checkout",
+		"title":                 req.Description,
+		"total_amount":          fmt.Sprintf("%.2f", req.Amount),
+		"trans_currency":        req.Currency,
+		"timeout_express":       "120m",
+		"business_type":         "BuyGoods",
+		"payee_identifier":      s.merchCode,
+		"payee_identifier_type": "04",
+		"payee_type":            "5000",
+		"callback_info":         req.TxRef,
+	}, &order)
+	if err != nil {
+		return "", fmt.Errorf("payment initialization failed: %w", err)
+	}
+	if order.PrepayID == "" {
+		return "", errors.New("payment initialization failed: no prepay_id returned")
+	}
+
+	// The buyer's browser opens the checkout page with a signed raw request
+	nonce, err := telebirrNonce()
+	if err != nil {
+		return "", err
+	}
+	raw := map[string]string{
+		"appid":      s.appID,
+		"merch_code": s.merchCode,
+		"nonce_str":  nonce,
+		"prepay_id":  order.PrepayID,
+		"timestamp":  strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	sign, err := s.sign(raw)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	for key, value := range raw {
+		query.Set(key, value)
+	}
+	query.Set("sign", sign)
+	query.Set("sign_type", "SHA256WithRSA")
+	query.Set("version", "1.0")
+	query.Set("trade_type", "Checkout")
+
+	return s.checkoutURL + "?" + query.Encode(), nil
+}
+
+func (s *TelebirrService) Verify(reference string) (*PaymentResult, error) {
+	var order struct {
+		OrderStatus   string `json:"order_status"`
+		TotalAmount   string `json:"total_amount"`
+		TransCurrency string `json:"trans_currency"`
+	}
+	err := s.call("/payment/v1/merchant/queryOrder", "payment.queryorder", map[string]string{
+		"appid":          s.appID,
+		"merch_code":     s.merchCode,
+		"merch_order_id": reference,
+	}, &order)
+	if err != nil {
+		return nil, fmt.Errorf("payment verification failed: %w", err)
+	}
+
+	status := PaymentFailed
+	switch order.OrderStatus {
+	case "PAY_SUCCESS":
+		status = PaymentSucceeded
+	case "WAIT_PAY", "PAYING", "ACCEPTED":
+		status = PaymentPending
+	}
+
+	// An amount we can't read must not turn a paid order into a failed
+	// purchase; erroring leaves it pending for the next verify or webhook
+	amount, err := strconv.ParseFloat(order.TotalAmount, 64)
+	if err != nil && status == PaymentSucceeded {
+		return nil, fmt.Errorf("payment verification failed: invalid total_amount %q", order.TotalAmount)
+	}
+
+	return &PaymentResult{
+		Reference: reference,
+		Status:    status,
+		Amount:    amount,
+		Currency:  order.TransCurrency,
+	}, nil
+}
+
+// Refund returns a payment in full. A purchase is refunded at most once, so
+// the request number is derived from the order: a retry after a refund that
+// went through but wasn't recorded is recognised by Telebirr as the same
+// refund instead of a second one.
+func (s *TelebirrService) Refund(reference string, amount float64, reason string) error {
+	var refund struct {
+		RefundStatus string `json:"refund_status"`
+	}
+	err := s.call("/payment/v1/merchant/refund", "payment.refund", map[string]string{
+		"appid":             s.appID,
+		"merch_code":        s.merchCode,
+		"merch_order_id":    reference,
+		"refund_request_no": reference + "_refund",
+		"refund_reason":     reason,
+		"actual_amount":     fmt.Sprintf("%.2f", amount),
+		"trans_currency":    "ETB",
+	}, &refund)
+	if err != nil {
+		return fmt.Errorf("refund failed: %w", err)
+	}
+	if refund.RefundStatus == "REFUND_FAILED" {
+		return errors.New("refund failed: rejected by Telebirr")
+	}
+
+	return nil
+}
+
+// ParseWebhook verifies a payment notification against Telebirr's public
+// key (TELEBIRR_PUBLIC_KEY_FILE). The signature covers every field of the
+// JSON body except sign and sign_type.
+func (s *TelebirrService) ParseWebhook(header http.Header, body []byte) (*WebhookEvent, error) {
+	if s.publicKey == nil {
+		return nil, ErrWebhookNotConfigured
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var notification map[string]interface{}
+	if err := decoder.Decode(&notification); err != nil {
+		return nil, ErrInvalidWebhookPayload
+	}
+
+	fields := make(map[string]string, len(notification))
+	for key, value := range notification {
+		if value == nil {
+			continue
+		}
+		fields[key] = fmt.Sprint(value)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(fields["sign"])
+	if err != nil {
+		return nil, ErrInvalidWebhookSignature
+	}
+	digest := sha256.Sum256([]byte(telebirrSignString(fields)))
+	if err := rsa.VerifyPSS(s.publicKey, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}); err != nil {
+		return nil, ErrInvalidWebhookSignature
+	}
+
+	if fields["merch_order_id"] == "" || fields["appid"] != s.appID {
+		return nil, ErrInvalidWebhookPayload
+	}
+
+	status := PaymentPending
+	switch fields["trade_status"] {
+	case "Completed":
+		status = PaymentSucceeded
+	case "Failure", "Expired":
+		status = PaymentFailed
+	}
+
+	return &WebhookEvent{Reference: fields["merch_order_id"], Status: status}, nil
+}
+
+// call sends a signed request for method to path and decodes the response's
+// biz_content into out.
+func (s *TelebirrService) call(path, method string, bizContent map[string]string, out interface{}) error {
+	token, err := s.fabricToken()
+	if err != nil {
+		return err
+	}
+
+	nonce, err := telebirrNonce()
+	if err != nil {
+		return err
+	}
+
+	request := map[string]string{
+		"timestamp": strconv.FormatInt(time.Now().Unix(), 10),
+		"nonce_str": nonce,
+		"method":    method,
+		"version":   "1.0",
+	}
+
+	// The signature covers the request fields and biz_content's together
+	signed := make(map[string]string, len(request)+len(bizContent))
+	for key, value := range request {
+		signed[key] = value
+	}
+	for key, value := range bizContent {
+		signed[key] = value
+	}
+	sign, err := s.sign(signed)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"timestamp":   request["timestamp"],
+		"nonce_str":   request["nonce_str"],
+		"method":      request["method"],
+		"version":     request["version"],
+		"biz_content": bizContent,
+		"sign_type":   "SHA256WithRSA",
+		"sign":        sign,
+	})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", s.baseURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-APP-Key", s.fabricAppID)
+	httpReq.Header.Set("Authorization", token)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var telebirrResp telebirrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&telebirrResp); err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK || telebirrResp.Result != "SUCCESS" {
+		message := telebirrResp.Msg
+		if telebirrResp.ErrorMsg != "" {
+			message = telebirrResp.ErrorMsg
+		}
+		return fmt.Errorf("telebirr returned %s", message)
+	}
+
+	if err := json.Unmarshal(telebirrResp.BizContent, out); err != nil {
+		return fmt.Errorf("unexpected telebirr response: %w", err)
+	}
+
+	return nil
+}
+
+// fabricToken returns the access token for the API, fetching a new one once
+// the current token has expired. The fetch happens outside the lock, and
+// callers that need a token while one is being fetched wait for that one.
+func (s *TelebirrService) fabricToken() (string, error) {
+	s.mu.Lock()
+
+	if s.token != "" && time.Now().Before(s.tokenExpiry) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+
+	if call := s.inflight; call != nil {
+		s.mu.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+
+	call := &telebirrTokenFetch{done: make(chan struct{})}
+	s.inflight = call
+	s.mu.Unlock()
+
+	token, expiry, err := s.fetchFabricToken()
+
+	s.mu.Lock()
+	if err == nil {
+		s.token = token
+		s.tokenExpiry = expiry
+	}
+	call.token, call.err = token, err
+	s.inflight = nil
+	close(call.done)
+	s.mu.Unlock()
+
+	return token, err
+}
+
+// fetchFabricToken requests a new access token and returns it with the time
+// it should be renewed.
+func (s *TelebirrService) fetchFabricToken() (string, time.Time, error) {
+	jsonData, err := json.Marshal(map[string]string{"appSecret": s.appSecret})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	httpReq, err := http.NewRequest("POST", s.baseURL+"/payment/v1/token", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-APP-Key", s.fabricAppID)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	var tokenResp struct {
+		Token          string `json:"token"`
+		ExpirationDate string `json:"expirationDate"`
+		ErrorMsg       string `json:"errorMsg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK || tokenResp.Token == "" {
+		return "", time.Time{}, fmt.Errorf("telebirr token request failed: %s", tokenResp.ErrorMsg)
+	}
+
+	// Renew a minute early; assume a short lifetime if the date is missing
+	expiry, err := time.ParseInLocation("20060102150405", tokenResp.ExpirationDate, time.Local)
+	if err != nil {
+		expiry = time.Now().Add(10 * time.Minute)
+	}
+
+	return tokenResp.Token, expiry.Add(-time.Minute), nil
+}
+
+// sign returns the base64 SHA256WithRSA (RSA-PSS) signature of fields.
+func (s *TelebirrService) sign(fields map[string]string) (string, error) {
+	digest := sha256.Sum256([]byte(telebirrSignString(fields)))
+	signature, err := rsa.SignPSS(rand.Reader, s.privateKey, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// telebirrSignString is the string Telebirr signs: key=value pairs sorted by
+// key and joined with "&", leaving out the signature itself.
+func telebirrSignString(fields map[string]string) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key == "sign" || key == "sign_type" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + fields[key]
+	}
+	return strings.Join(pairs, "&")
+}
+
+func telebirrNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
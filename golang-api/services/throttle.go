@@ -0,0 +1,209 @@
+package services
+
+import (
+	"strings"
+	"time"
+
+	"recipehub/models"
+)
+
+// ThrottleRule turns a failure count into a wait: the first FreeAttempts
+// failures cost nothing, after that the wait doubles from BaseDelay up to
+// MaxDelay. Counts reset once a key has been quiet for Window.
+type ThrottleRule struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+// Delay returns how long to wait after the given number of failures.
+func (r ThrottleRule) Delay(failures int) time.Duration {
+	if failures < r.FreeAttempts {
+		return 0
+	}
+
+	shift := failures - r.FreeAttempts
+	if shift > 30 {
+		return r.MaxDelay
+	}
+	if delay := r.BaseDelay << shift; delay < r.MaxDelay {
+		return delay
+	}
+	return r.MaxDelay
+}
+
+var (
+	// Per IP address is looser since many users can share one behind NAT
+	LoginIPRule      = ThrottleRule{FreeAttempts: 10, BaseDelay: time.Second, MaxDelay: 15 * time.Minute, Window: time.Hour}
+	LoginAccountRule = ThrottleRule{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 5 * time.Minute, Window: time.Hour}
+
+	// Password reset requests count whether or not they succeed
+	PasswordResetIPRule      = ThrottleRule{FreeAttempts: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: time.Hour}
+	PasswordResetAccountRule = ThrottleRule{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+
+	// Every SMS costs money, so codes are limited per number as well as per IP
+	PhoneOTPIPRule     = ThrottleRule{FreeAttempts: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: time.Hour}
+	PhoneOTPNumberRule = ThrottleRule{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+)
+
+const (
+	// LockoutThreshold failed logins for one account within
+	// LoginAccountRule.Window lock it for LockoutDuration.
+	LockoutThreshold = 10
+	LockoutDuration  = 15 * time.Minute
+)
+
+// LoginThrottle slows down password guessing with per-IP and per-account
+// backoff, and temporarily locks an account after repeated failures. Every
+// lockout is recorded in account_lockouts so support can lift it early.
+type LoginThrottle struct {
+	store AttemptStore
+	db    *DatabaseService
+}
+
+func NewLoginThrottle(store AttemptStore, dbService *DatabaseService) *LoginThrottle {
+	return &LoginThrottle{
+		store: store,
+		db:    dbService,
+	}
+}
+
+// LoginAccount is what attempts on a signed-in user are counted and locked
+// against: their email, or their phone number for accounts created by phone
+// login, which have no email. Keying those by "" would make every such
+// account share one counter and one lockout.
+func LoginAccount(user *models.User) string {
+	if user.Email != "" {
+		return NormalizeEmail(user.Email)
+	}
+	return user.Phone
+}
+
+// ParseLoginAccount reads an email address or phone number given by support
+// into the form LoginAccount records lockouts under.
+func ParseLoginAccount(raw string) (string, error) {
+	if strings.Contains(raw, "@") {
+		return NormalizeEmail(raw), nil
+	}
+	return NormalizePhone(raw)
+}
+
+// Accounts are keyed by normalised email (or LoginAccount) whether or not
+// they exist, so throttling doesn't reveal which addresses are registered.
+func loginAccountKey(account string) string {
+	return "login:account:" + NormalizeEmail(account)
+}
+
+// CheckLogin returns how long the caller has to wait before attempting to log
+// in, and whether that is because the account is locked. account is an email
+// address as typed at login, or LoginAccount for a signed-in user.
+func (t *LoginThrottle) CheckLogin(ip, account string) (time.Duration, bool, error) {
+	remaining, err := t.db.GetAccountLockout(NormalizeEmail(account))
+	if err != nil {
+		return 0, false, err
+	}
+	if remaining > 0 {
+		return remaining, true, nil
+	}
+
+	wait, err := t.wait(
+		throttleKey{"login:ip:" + ip, LoginIPRule},
+		throttleKey{loginAccountKey(account), LoginAccountRule},
+	)
+	return wait, false, err
+}
+
+// LoginFailed records a failed login and locks the account once it reaches
+// LockoutThreshold. userID may be empty for an unknown email.
+func (t *LoginThrottle) LoginFailed(ip, account, userID string) (bool, error) {
+	if _, err := t.store.Fail("login:ip:"+ip, LoginIPRule.Window); err != nil {
+		return false, err
+	}
+
+	failures, err := t.store.Fail(loginAccountKey(account), LoginAccountRule.Window)
+	if err != nil || failures < LockoutThreshold {
+		return false, err
+	}
+
+	err = t.db.CreateAccountLockout(NormalizeEmail(account), userID, ip, failures, LockoutDuration)
+	if err != nil {
+		return false, err
+	}
+
+	// The lockout takes over from the counter; afterwards the account
+	// starts again from zero
+	return true, t.store.Reset(loginAccountKey(account))
+}
+
+// LoginSucceeded clears the account's failure count. The IP's is kept, so
+// logging into an account of one's own doesn't reset it.
+func (t *LoginThrottle) LoginSucceeded(account string) error {
+	return t.store.Reset(loginAccountKey(account))
+}
+
+// AllowPasswordReset counts a password reset request and returns how long
+// the caller has to wait if it is over the limit (in which case it isn't
+// counted).
+func (t *LoginThrottle) AllowPasswordReset(ip, email string) (time.Duration, error) {
+	return t.allow(
+		throttleKey{"reset:ip:" + ip, PasswordResetIPRule},
+		throttleKey{"reset:account:" + NormalizeEmail(email), PasswordResetAccountRule},
+	)
+}
+
+// AllowPhoneOTP counts a request for an SMS login code the same way
+// AllowPasswordReset counts reset requests. phone must be normalised.
+func (t *LoginThrottle) AllowPhoneOTP(ip, phone string) (time.Duration, error) {
+	return t.allow(
+		throttleKey{"otp:ip:" + ip, PhoneOTPIPRule},
+		throttleKey{"otp:phone:" + phone, PhoneOTPNumberRule},
+	)
+}
+
+// UnlockAccount lifts an active lockout and clears the failure count.
+// account is an email address or, for phone login accounts, the normalised
+// phone number.
+func (t *LoginThrottle) UnlockAccount(account, unlockedBy string) (bool, error) {
+	unlocked, err := t.db.UnlockAccount(NormalizeEmail(account), unlockedBy)
+	if err != nil {
+		return false, err
+	}
+	return unlocked, t.store.Reset(loginAccountKey(account))
+}
+
+type throttleKey struct {
+	key  string
+	rule ThrottleRule
+}
+
+// allow counts a request against every key unless one of them still has to
+// wait, in which case nothing is counted and the wait is returned.
+func (t *LoginThrottle) allow(keys ...throttleKey) (time.Duration, error) {
+	wait, err := t.wait(keys...)
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+
+	for _, k := range keys {
+		if _, err := t.store.Fail(k.key, k.rule.Window); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// wait returns the longest remaining backoff across keys.
+func (t *LoginThrottle) wait(keys ...throttleKey) (time.Duration, error) {
+	var longest time.Duration
+	for _, k := range keys {
+		failures, since, err := t.store.Failures(k.key, k.rule.Window)
+		if err != nil {
+			return 0, err
+		}
+		if wait := k.rule.Delay(failures) - since; wait > longest {
+			longest = wait
+		}
+	}
+	return longest, nil
+}
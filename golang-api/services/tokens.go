@@ -0,0 +1,142 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"recipehub/models"
+)
+
+// TokenPurpose scopes a single-use token to one flow. The purpose is part of
+// both the lookup and the stored digest, so a token issued for one flow can
+// never be redeemed in another.
+type TokenPurpose string
+
+const (
+	TokenPurposePasswordReset     TokenPurpose = "password_reset"
+	TokenPurposeEmailVerification TokenPurpose = "email_verification"
+	TokenPurposeMFAChallenge      TokenPurpose = "mfa_challenge"
+	TokenPurposeEmailChange       TokenPurpose = "email_change"
+	TokenPurposeMagicLink         TokenPurpose = "magic_link"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// IssueToken creates a single-use token for the user and returns it. Only a
+// selector and a SHA-256 digest of the secret part are stored; earlier live
+// tokens of the same purpose are expired.
+//
+// Tokens have the form "<selector>.<verifier>": the selector finds the row
+// and the verifier is checked against the digest in constant time.
+func (s *AuthService) IssueToken(userID string, purpose TokenPurpose, ttl time.Duration) (string, error) {
+	return s.IssueTokenWithPayload(userID, purpose, "", ttl)
+}
+
+// IssueTokenWithPayload is IssueToken for flows that need to remember a value
+// until the token is redeemed, such as the new address of an email change.
+// The payload is stored server-side and never part of the token.
+func (s *AuthService) IssueTokenWithPayload(userID string, purpose TokenPurpose, payload string, ttl time.Duration) (string, error) {
+	selector, err := randomToken(12)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.db.SaveAuthToken(&models.AuthToken{
+		UserID:    userID,
+		Purpose:   string(purpose),
+		Selector:  selector,
+		TokenHash: hashToken(purpose, selector, verifier),
+		Payload:   payload,
+	}, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	return selector + "." + verifier, nil
+}
+
+// PeekToken returns the user a token was issued to without redeeming it, so
+// a request can be validated before the token is used up.
+func (s *AuthService) PeekToken(purpose TokenPurpose, token string) (string, error) {
+	stored, err := s.lookupToken(purpose, token)
+	if err != nil {
+		return "", err
+	}
+	return stored.UserID, nil
+}
+
+// ConsumeToken redeems a token issued for purpose and returns its user ID.
+// The token is marked consumed, so a second redemption fails with
+// ErrInvalidToken.
+func (s *AuthService) ConsumeToken(purpose TokenPurpose, token string) (string, error) {
+	userID, _, err := s.ConsumeTokenWithPayload(purpose, token)
+	return userID, err
+}
+
+// ConsumeTokenWithPayload redeems a token like ConsumeToken and also returns
+// the payload it was issued with.
+func (s *AuthService) ConsumeTokenWithPayload(purpose TokenPurpose, token string) (string, string, error) {
+	stored, err := s.lookupToken(purpose, token)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Marking the row consumed is what makes the token single-use; if a
+	// concurrent request got there first this one loses
+	consumed, err := s.db.ConsumeAuthToken(stored.ID)
+	if err != nil {
+		return "", "", err
+	}
+	if !consumed {
+		return "", "", ErrInvalidToken
+	}
+
+	return stored.UserID, stored.Payload, nil
+}
+
+// lookupToken finds a live token and checks its verifier.
+func (s *AuthService) lookupToken(purpose TokenPurpose, token string) (*models.AuthToken, error) {
+	selector, verifier, ok := strings.Cut(token, ".")
+	if !ok || selector == "" || verifier == "" {
+		return nil, ErrInvalidToken
+	}
+
+	stored, err := s.db.GetAuthToken(purpose, selector)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expected := hashToken(purpose, selector, verifier)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(stored.TokenHash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	return stored, nil
+}
+
+func hashToken(purpose TokenPurpose, selector, verifier string) string {
+	sum := sha256.Sum256([]byte(string(purpose) + "\x00" + selector + "\x00" + verifier))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(size int) (string, error) {
+	bytes := make([]byte, size)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
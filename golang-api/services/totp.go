@@ -0,0 +1,164 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTPIssuer = "RecipeHub"
+
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many periods either side of now a code is accepted
+	// for, to allow for clock drift on the user's device.
+	totpSkew = 1
+
+	// MFAChallengeTTL is how long a user has to enter their second factor
+	// after the password step of a login.
+	MFAChallengeTTL   = 5 * time.Minute
+	RecoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 TOTP secret (RFC 4226
+// recommends 160 bits).
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI that authenticator apps
+// read from a QR code.
+func TOTPProvisioningURI(secret, account string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {TOTPIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// TOTPCode computes the RFC 6238 code for the time step containing t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCodeAt(secret, t.Unix()/totpPeriod)
+}
+
+// MatchTOTP checks code against the steps around now and returns the step it
+// matched, which callers record so the same code can't be replayed.
+func MatchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCodeAt(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpCodeAt(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// GenerateRecoveryCodes returns new one-time recovery codes in plain text,
+// to be shown to the user once, along with the digests to store.
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	// Crockford's base32 alphabet: 32 symbols, so no modulo bias, and no
+	// easily confused letters
+	const alphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+
+		var code strings.Builder
+		for j, b := range raw {
+			if j == 5 {
+				code.WriteByte('-')
+			}
+			code.WriteByte(alphabet[b%32])
+		}
+
+		codes[i] = code.String()
+		hashes[i] = HashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode normalises a recovery code as typed by the user and
+// returns its digest.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused recovery
+// code for a user with 2FA enabled. Both are single-use.
+func (s *AuthService) VerifySecondFactor(userID, code string) (bool, error) {
+	totp, err := s.db.GetUserTOTP(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if totp.EnabledAt == nil {
+		return false, nil
+	}
+
+	if step, ok := MatchTOTP(totp.Secret, code, time.Now()); ok {
+		return s.db.UseTOTPStep(userID, step)
+	}
+
+	return s.db.UseRecoveryCode(userID, HashRecoveryCode(code))
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The RFC 6238 test secret, "12345678901234567890" in base32
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := TOTPCode(rfcTOTPSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTPSkewWindow(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / totpPeriod
+	period := totpPeriod * time.Second
+
+	code := func(at time.Time) string {
+		c, err := TOTPCode(rfcTOTPSecret, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", code(now), current, true},
+		{"previous step", code(now.Add(-period)), current - 1, true},
+		{"next step", code(now.Add(period)), current + 1, true},
+		{"surrounding spaces", " " + code(now) + " ", current, true},
+		{"two steps old", code(now.Add(-2 * period)), 0, false},
+		{"two steps ahead", code(now.Add(2 * period)), 0, false},
+		{"too short", code(now)[:5], 0, false},
+		{"empty", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := MatchTOTP(rfcTOTPSecret, tt.code, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("MatchTOTP(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMatchTOTPRejectsBadSecret(t *testing.T) {
+	if _, ok := MatchTOTP("not base32!", "123456", time.Now()); ok {
+		t.Error("a code matched an undecodable secret")
+	}
+}
+
+func TestRecoveryCodesMatchAsTyped(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), RecoveryCodeCount)
+	}
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if seen[hashes[i]] {
+			t.Errorf("duplicate recovery code %s", code)
+		}
+		seen[hashes[i]] = true
+
+		for _, typed := range []string{
+			code,
+			strings.ToUpper(code),
+			strings.ReplaceAll(code, "-", ""),
+			"  " + code + "\n",
+		} {
+			if HashRecoveryCode(typed) != hashes[i] {
+				t.Errorf("%q does not match recovery code %s", typed, code)
+			}
+		}
+	}
+
+	if HashRecoveryCode(codes[0]) == HashRecoveryCode(codes[1]) {
+		t.Error("different recovery codes share a digest")
+	}
+}
@@ -29,7 +29,40 @@ export const useAuthStore = defineStore("auth", () => {
     }
   }
 
-  // Login with email and password
+  // Keep a signed-in session from a login or 2FA response
+  const saveSession = (result, rememberMe) => {
+    token.value = result.access_token
+    user.value = result.user
+
+    // Save to localStorage
+    if (process.client) {
+      localStorage.setItem("auth_token", result.access_token)
+      localStorage.setItem("auth_user", JSON.stringify(result.user))
+
+      if (rememberMe) {
+        localStorage.setItem("remember_me", "true")
+      }
+    }
+
+    // Set Apollo client auth header
+    $apollo.defaultClient.setHeader("Authorization", `Bearer ${result.access_token}`)
+  }
+
+  const AUTH_USER_FIELDS = `
+    id
+    email
+    first_name
+    last_name
+    username
+    avatar
+    bio
+    is_verified
+    created_at
+  `
+
+  // Login with email and password. Accounts with 2FA get back
+  // { mfa_required: true, challenge_token } instead of tokens; finish the
+  // login with verifyMfa.
   const login = async (credentials) => {
     isLoading.value = true
 
@@ -41,16 +74,10 @@ export const useAuthStore = defineStore("auth", () => {
             message
             access_token
             refresh_token
+            mfa_required
+            challenge_token
             user {
-              id
-              email
-              first_name
-              last_name
-              username
-              avatar
-              bio
-              is_verified
-              created_at
+              ${AUTH_USER_FIELDS}
             }
           }
         }
@@ -66,29 +93,64 @@ export const useAuthStore = defineStore("auth", () => {
         },
       })
 
-      if (data.login.success) {
-        token.value = data.login.access_token
-        user.value = data.login.user
+      if (data.login.mfa_required) {
+        return data.login
+      }
+
+      if (data.login.success && data.login.access_token) {
+        saveSession(data.login, credentials.rememberMe)
+      } else {
+        throw new Error(data.login.message)
+      }
+
+      return data.login
+    } catch (error) {
+      console.error("Login error:", error)
+      throw error
+    } finally {
+      isLoading.value = false
+    }
+  }
 
-        // Save to localStorage
-        if (process.client) {
-          localStorage.setItem("auth_token", data.login.access_token)
-          localStorage.setItem("auth_user", JSON.stringify(data.login.user))
+  // Finish a 2FA login with the challenge token from login and a TOTP or
+  // recovery code
+  const verifyMfa = async (challengeToken, code, rememberMe) => {
+    isLoading.value = true
 
-          if (credentials.rememberMe) {
-            localStorage.setItem("remember_me", "true")
+    try {
+      const VERIFY_MFA_ACTION = gql`
+        mutation VerifyMfa($input: MFAVerifyInput!) {
+          verifyMfa(input: $input) {
+            success
+            message
+            access_token
+            refresh_token
+            user {
+              ${AUTH_USER_FIELDS}
+            }
           }
         }
+      `
 
-        // Set Apollo client auth header
-        $apollo.defaultClient.setHeader("Authorization", `Bearer ${data.login.access_token}`)
+      const { data } = await $apollo.mutate({
+        mutation: VERIFY_MFA_ACTION,
+        variables: {
+          input: {
+            challenge_token: challengeToken,
+            code,
+          },
+        },
+      })
+
+      if (data.verifyMfa.success && data.verifyMfa.access_token) {
+        saveSession(data.verifyMfa, rememberMe)
       } else {
-        throw new Error(data.login.message)
+        throw new Error(data.verifyMfa.message)
       }
 
-      return data.login
+      return data.verifyMfa
     } catch (error) {
-      console.error("Login error:", error)
+      console.error("2FA verification error:", error)
       throw error
     } finally {
       isLoading.value = false
@@ -189,7 +251,7 @@ export const useAuthStore = defineStore("auth", () => {
   }
 
   // Initialize payment
-  const initializePayment = async (recipeId, amount) => {
+  const initializePayment = async (recipeId, paymentMethod) => {
     try {
       const INITIALIZE_PAYMENT = gql`
         mutation InitializePayment($input: PaymentInput!) {
@@ -206,7 +268,7 @@ export const useAuthStore = defineStore("auth", () => {
         variables: {
           input: {
             recipe_id: recipeId,
-            amount: amount,
+            payment_method: paymentMethod,
           },
         },
       })
@@ -231,6 +293,7 @@ export const useAuthStore = defineStore("auth", () => {
     // Actions
     initAuth,
     login,
+    verifyMfa,
     signup,
     logout,
     uploadFile,